@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/yaml"
+)
+
+// Batch is a set of label changes applied together by batch. Items use the
+// plan item fields; expected_digest is optional.
+type Batch struct {
+	Items []PlanItem `json:"items"`
+}
+
+// tagMove is a tag pointed at a new digest during a batch, with the digest it
+// had before or "" when it did not exist
+type tagMove struct {
+	tag      name.Tag
+	previous string
+}
+
+// batchItem tracks one item through a batch
+type batchItem struct {
+	item   PlanItem
+	result Result
+	ref    name.Reference
+	moved  []tagMove
+	retry  *retrier
+	opts   []remote.Option
+}
+
+// loadBatch reads a YAML or JSON batch file
+func loadBatch(path string) (*Batch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	batch, err := parseBatch(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing batch %s: %v", path, err)
+	}
+	return batch, nil
+}
+
+// parseBatch parses a YAML or JSON batch
+func parseBatch(data []byte) (*Batch, error) {
+	var batch Batch
+	if err := yaml.UnmarshalStrict(data, &batch); err != nil {
+		return nil, err
+	}
+	if len(batch.Items) == 0 {
+		return nil, fmt.Errorf("batch contains no changes")
+	}
+	return &batch, nil
+}
+
+// runBatch applies every change in batch or none of them. All new manifests are
+// pushed by digest first; tags are only moved once every push succeeded. If a
+// tag cannot be moved, the tags already moved are pointed back at their
+// previous digests. A result is returned per item describing its final state.
+func runBatch(batch *Batch, opts Options) []Result {
+	// Staged manifests skip the steps that follow a push, so refuse to run
+	// without them rather than silently leave the new digests unsigned
+	if opts.CopyReferrers || opts.SignKey != "" || opts.Provenance {
+		return []Result{{
+			Error:     "--copy-referrers, --sign-key and --provenance are not supported by batch",
+			ErrorCode: ErrInvalidArguments,
+		}}
+	}
+
+	items := make([]*batchItem, len(batch.Items))
+
+	// Stage every new manifest without touching any tag
+	stageOpts := opts
+	stageOpts.Stage = true
+	failed := -1
+	for i, item := range batch.Items {
+		itemOpts := stageOpts
+		itemOpts.ExpectDigest = item.ExpectedDigest
+		itemOpts.ExpectTagDigests = item.TagDigests
+		items[i] = &batchItem{item: item, result: item.run(itemOpts)}
+		if !items[i].result.Success && failed < 0 {
+			failed = i
+		}
+	}
+	if failed >= 0 {
+		return abortBatch(items, failed)
+	}
+
+	// Move the tags of each item in turn
+	for i, b := range items {
+		if err := b.prepare(opts); err == nil {
+			err = b.moveTags()
+			if err == nil {
+				continue
+			}
+		}
+		failed = i
+		break
+	}
+	if failed >= 0 {
+		rollbackBatch(items, failed)
+		return abortBatch(items, failed)
+	}
+
+	results := make([]Result, len(items))
+	for i, b := range items {
+		before := make(map[string]string, len(b.moved))
+		for _, move := range b.moved {
+			before[move.tag.String()] = move.previous
+		}
+		recordOperation(&b.result, b.ref, before, opts)
+		results[i] = b.result
+	}
+	return results
+}
+
+// prepare resolves the reference and credentials used to move the item's tags
+func (b *batchItem) prepare(opts Options) error {
+	ref, err := name.ParseReference(b.item.ImageRef)
+	if err != nil {
+		b.result.Success = false
+		b.result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
+		b.result.ErrorCode = ErrInvalidReference
+		return err
+	}
+	auth, err := opts.keychain().Resolve(ref.Context())
+	if err != nil {
+		b.result.Success = false
+		b.result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		b.result.ErrorCode = ErrAuthFailed
+		return err
+	}
+
+	st := readTransport(opts)
+	b.ref = ref
+	b.retry = &retrier{policy: opts.Retry, transport: st, result: &b.result}
+	b.opts = remoteOptions(auth, st)
+	return nil
+}
+
+// moveTags points the item's source tag and new tags at its staged digest. The
+// source tag must still be at the old digest.
+func (b *batchItem) moveTags() error {
+	repo := b.ref.Context()
+	staged := repo.Digest(b.result.NewDigest)
+
+	var tags []name.Tag
+	source, hasSource := b.ref.(name.Tag)
+	if hasSource {
+		tags = append(tags, source)
+	}
+	for _, t := range b.item.Tags {
+		tags = append(tags, repo.Tag(t))
+	}
+
+	for i, tag := range tags {
+		isSource := hasSource && i == 0
+		var previous string
+		err := b.retry.do("fetch", func() error {
+			desc, err := remote.Head(tag, b.opts...)
+			if err != nil {
+				return err
+			}
+			previous = desc.Digest.String()
+			return nil
+		})
+		if err != nil && !isNotFound(err) {
+			b.fail("Error getting tag %s: %v", err, ErrAuthFailed, tag, err)
+			return err
+		}
+		if isSource && previous != b.result.OldDigest {
+			err := newError(ErrPreconditionFailed, "%s has moved from %s to %s", tag, b.result.OldDigest, previous)
+			b.fail("%v", err, ErrPreconditionFailed, err)
+			return err
+		}
+
+		err = b.retry.do("tag", func() error {
+			desc, err := remote.Get(staged, b.opts...)
+			if err != nil {
+				return err
+			}
+			return remote.Put(tag, desc, b.opts...)
+		})
+		if err != nil {
+			b.fail("Error tagging %s: %v", err, ErrPushDenied, tag, err)
+			return err
+		}
+		b.moved = append(b.moved, tagMove{tag: tag, previous: previous})
+		if !isSource {
+			b.result.TaggedAs = append(b.result.TaggedAs, tag.String())
+		}
+	}
+	return nil
+}
+
+// fail marks the item failed with a message and the registry error code of err
+func (b *batchItem) fail(format string, err error, fallback ErrorCode, args ...interface{}) {
+	b.result.Success = false
+	b.result.Error = fmt.Sprintf(format, args...)
+	b.result.ErrorCode = registryErrorCode(err, fallback)
+}
+
+// rollbackBatch points every tag moved by items up to and including failed
+// back at its previous digest, newest first. Tags that did not exist before are
+// deleted. Tags that cannot be restored are reported as warnings.
+func rollbackBatch(items []*batchItem, failed int) {
+	for i := failed; i >= 0; i-- {
+		b := items[i]
+		for j := len(b.moved) - 1; j >= 0; j-- {
+			move := b.moved[j]
+			err := b.retry.do("rollback", func() error {
+				if move.previous == "" {
+					return remote.Delete(move.tag, b.opts...)
+				}
+				desc, err := remote.Get(move.tag.Context().Digest(move.previous), b.opts...)
+				if err != nil {
+					return err
+				}
+				return remote.Put(move.tag, desc, b.opts...)
+			})
+			if err != nil {
+				b.result.Warnings = append(b.result.Warnings, fmt.Sprintf("Could not roll back %s to %s: %v", move.tag, rollbackTarget(move), err))
+				continue
+			}
+			b.result.RolledBack = append(b.result.RolledBack, move.tag.String())
+		}
+		b.result.TaggedAs = nil
+	}
+}
+
+// rollbackTarget describes where a tag should have been rolled back to
+func rollbackTarget(move tagMove) string {
+	if move.previous == "" {
+		return "nothing"
+	}
+	return move.previous
+}
+
+// abortBatch marks every item other than the failed one as not applied
+func abortBatch(items []*batchItem, failed int) []Result {
+	results := make([]Result, len(items))
+	for i, b := range items {
+		if i != failed && b.result.Success {
+			b.result.Success = false
+			b.result.Error = fmt.Sprintf("Not applied because %s failed: %s", items[failed].item.ImageRef, items[failed].result.Error)
+			b.result.ErrorCode = ErrPreconditionFailed
+		}
+		results[i] = b.result
+	}
+	return results
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestBatchAppliesEveryItem(t *testing.T) {
+	host := newTestRegistry(t)
+	pushTestImage(t, host+"/test/app:1", map[string]string{"quay.expires-after": "1w"})
+	pushTestImage(t, host+"/test/sidecar:1", map[string]string{"release": "rc"})
+
+	batch := &Batch{Items: []PlanItem{
+		{Command: "remove-labels", ImageRef: host + "/test/app:1", Remove: []string{"quay.expires-after"}, Tags: []string{"stable"}},
+		{Command: "update-labels", ImageRef: host + "/test/sidecar:1", Update: map[string]string{"release": "ga"}},
+	}}
+
+	results := runBatch(batch, Options{Journal: filepath.Join(t.TempDir(), "journal.jsonl")})
+	for _, result := range results {
+		if !result.Success || result.Operation == "" {
+			t.Errorf("Expected every item to be applied and journaled, got %+v", result)
+		}
+	}
+	if got := tagDigest(t, host+"/test/app:stable"); got != results[0].NewDigest {
+		t.Errorf("Expected stable at %s, got %s", results[0].NewDigest, got)
+	}
+	if got := tagDigest(t, host+"/test/sidecar:1"); got != results[1].NewDigest {
+		t.Errorf("Expected sidecar:1 at %s, got %s", results[1].NewDigest, got)
+	}
+}
+
+func TestBatchAbortsBeforeMovingTags(t *testing.T) {
+	host := newTestRegistry(t)
+	pushTestImage(t, host+"/test/app:1", map[string]string{"quay.expires-after": "1w"})
+	pushTestImage(t, host+"/test/sidecar:1", map[string]string{"release": "rc"})
+	before := tagDigest(t, host+"/test/app:1")
+
+	batch := &Batch{Items: []PlanItem{
+		{Command: "remove-labels", ImageRef: host + "/test/app:1", Remove: []string{"quay.expires-after"}},
+		{Command: "remove-labels", ImageRef: host + "/test/sidecar:1", Remove: []string{"missing"}},
+	}}
+
+	results := runBatch(batch, Options{})
+	if results[0].Success || results[0].ErrorCode != ErrPreconditionFailed {
+		t.Errorf("Expected app to be left unapplied, got %+v", results[0])
+	}
+	if results[1].ErrorCode != ErrNothingToChange {
+		t.Errorf("Expected the failing item to keep its error, got %+v", results[1])
+	}
+	if got := tagDigest(t, host+"/test/app:1"); got != before {
+		t.Errorf("Expected app:1 untouched, got %s", got)
+	}
+}
+
+func TestBatchRejectsPostPushSteps(t *testing.T) {
+	host := newTestRegistry(t)
+	pushTestImage(t, host+"/test/app:1", map[string]string{"release": "rc"})
+	before := tagDigest(t, host+"/test/app:1")
+	batch := &Batch{Items: []PlanItem{
+		{Command: "update-labels", ImageRef: host + "/test/app:1", Update: map[string]string{"release": "ga"}},
+	}}
+
+	for _, opts := range []Options{{CopyReferrers: true}, {SignKey: "cosign.key"}, {Provenance: true}} {
+		results := runBatch(batch, opts)
+		if len(results) != 1 || results[0].Success || results[0].ErrorCode != ErrInvalidArguments {
+			t.Errorf("Expected invalid-arguments for %+v, got %+v", opts, results)
+		}
+	}
+	if got := tagDigest(t, host+"/test/app:1"); got != before {
+		t.Errorf("Expected app:1 untouched, got %s", got)
+	}
+}
+
+func TestBatchRollsBackMovedTags(t *testing.T) {
+	host := refusingRegistry(t, pushesTo("/manifests/locked"))
+	pushTestImage(t, host+"/test/app:1", map[string]string{"quay.expires-after": "1w"})
+	pushTestImage(t, host+"/test/sidecar:1", map[string]string{"release": "rc"})
+	appBefore := tagDigest(t, host+"/test/app:1")
+	sidecarBefore := tagDigest(t, host+"/test/sidecar:1")
+
+	batch := &Batch{Items: []PlanItem{
+		{Command: "remove-labels", ImageRef: host + "/test/app:1", Remove: []string{"quay.expires-after"}, Tags: []string{"stable"}},
+		{Command: "update-labels", ImageRef: host + "/test/sidecar:1", Update: map[string]string{"release": "ga"}, Tags: []string{"locked"}},
+	}}
+
+	results := runBatch(batch, Options{})
+	if results[1].Success || results[1].ErrorCode != ErrPushDenied {
+		t.Errorf("Expected the locked tag to fail with push-denied, got %+v", results[1])
+	}
+	if results[0].Success || len(results[0].RolledBack) != 2 || len(results[0].TaggedAs) != 0 {
+		t.Errorf("Expected app:1 and app:stable to be rolled back, got %+v", results[0])
+	}
+	if len(results[1].RolledBack) != 1 {
+		t.Errorf("Expected sidecar:1 to be rolled back, got %+v", results[1])
+	}
+
+	if got := tagDigest(t, host+"/test/app:1"); got != appBefore {
+		t.Errorf("Expected app:1 back at %s, got %s", appBefore, got)
+	}
+	if got := tagDigest(t, host+"/test/sidecar:1"); got != sidecarBefore {
+		t.Errorf("Expected sidecar:1 back at %s, got %s", sidecarBefore, got)
+	}
+	if _, err := remote.Head(mustTag(t, host+"/test/app:stable")); !isNotFound(err) {
+		t.Errorf("Expected the new stable tag to be deleted, got %v", err)
+	}
+}
+
+func TestLoadBatch(t *testing.T) {
+	path := writeDesiredState(t, "items:\n- command: remove-labels\n  image_ref: quay.io/org/app:1\n  remove: [a]\n")
+	batch, err := loadBatch(path)
+	if err != nil || len(batch.Items) != 1 || batch.Items[0].Remove[0] != "a" {
+		t.Errorf("Expected one item, got %+v, %v", batch, err)
+	}
+	if _, err := loadBatch(writeDesiredState(t, "items: []\n")); err == nil {
+		t.Error("Expected an empty batch to be rejected")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// maxCachedSize bounds the responses kept in the content cache. Manifests and
+// configs are far smaller; anything larger is a layer and is never cached.
+const maxCachedSize = 4 << 20
+
+// cacheablePath matches registry paths addressing content by digest
+var cacheablePath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/sha256:([a-f0-9]{64})$`)
+
+// defaultCacheDir returns $XDG_CACHE_HOME/label-mod, falling back to ~/.cache
+// when XDG_CACHE_HOME is not set
+func defaultCacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "label-mod")
+}
+
+// contentCache keeps manifests and config blobs on disk keyed by registry,
+// repository and digest. Content is immutable, so an entry never needs
+// invalidating, but it is only served back to the repository it was read
+// from: having fetched it there says nothing about access to any other. Each
+// entry holds the media type on the first line followed by the content.
+type contentCache struct {
+	dir string
+}
+
+// newContentCache returns a cache in dir, or nil when dir is empty
+func newContentCache(dir string) *contentCache {
+	if dir == "" {
+		return nil
+	}
+	return &contentCache{dir: dir}
+}
+
+// readTransport returns a statusTransport that serves manifests and configs
+// from the content cache configured in opts
+func readTransport(opts Options) *statusTransport {
+	st := newStatusTransport(remote.DefaultTransport)
+	st.cache = newContentCache(opts.CacheDir)
+	return st
+}
+
+// cacheEntry identifies cached content: the registry and repository it was
+// read from, whether it is a manifest or blob, and the digest hex
+type cacheEntry struct {
+	registry   string
+	repository string
+	kind       string
+	hex        string
+}
+
+// cacheKey returns the entry for the content req fetches, or false when it
+// cannot be cached. Only GETs are cached: a HEAD asks whether content
+// exists in a particular repository, which the cache cannot answer. Blob
+// downloads are usually redirected to storage, so the original request is the
+// one that names the digest.
+func cacheKey(req *http.Request) (cacheEntry, bool) {
+	if req.Method != http.MethodGet {
+		return cacheEntry{}, false
+	}
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	m := cacheablePath.FindStringSubmatch(req.URL.Path)
+	if m == nil || req.URL.Host == "" {
+		return cacheEntry{}, false
+	}
+	repo, err := name.NewRepository(req.URL.Host+"/"+m[1], name.StrictValidation)
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	return cacheEntry{registry: req.URL.Host, repository: repo.RepositoryStr(), kind: m[2], hex: m[3]}, true
+}
+
+// path returns where entry is stored. Ports are kept in the registry directory
+// name with an underscore so the path is valid everywhere.
+func (c *contentCache) path(entry cacheEntry) string {
+	registry := strings.ReplaceAll(entry.registry, ":", "_")
+	return filepath.Join(c.dir, registry, filepath.FromSlash(entry.repository), entry.kind, "sha256", entry.hex)
+}
+
+// lookup returns a response for req from the cache, or nil on a miss. Entries
+// that no longer match their digest are removed.
+func (c *contentCache) lookup(req *http.Request) *http.Response {
+	entry, ok := cacheKey(req)
+	if !ok {
+		return nil
+	}
+	key := entry.hex
+	path := c.path(entry)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	mediaType, content, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || sha256Hex(content) != key {
+		os.Remove(path)
+		return nil
+	}
+
+	// Entries are pruned by last use
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	header := make(http.Header)
+	header.Set("Content-Type", string(mediaType))
+	header.Set("Content-Length", strconv.Itoa(len(content)))
+	header.Set("Docker-Content-Digest", "sha256:"+key)
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		Request:       req,
+	}
+}
+
+// store saves the content of a successful response to req and returns a
+// response the caller can read in its place. Content over maxCachedSize or
+// not matching the requested digest is passed through without being stored.
+func (c *contentCache) store(req *http.Request, resp *http.Response) (*http.Response, error) {
+	entry, ok := cacheKey(req)
+	if !ok || resp.StatusCode != http.StatusOK || resp.ContentLength > maxCachedSize {
+		return resp, nil
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedSize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(content) > maxCachedSize {
+		// Hand back what was read followed by the rest of the body
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(content), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(content))
+
+	if sha256Hex(content) == entry.hex {
+		mediaType := resp.Header.Get("Content-Type")
+		c.write(c.path(entry), append([]byte(mediaType+"\n"), content...))
+	}
+	return resp, nil
+}
+
+// write atomically creates an entry, ignoring failures: the cache only saves requests
+func (c *contentCache) write(path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), path)
+}
+
+// prune removes entries last used before cutoff, or every entry when cutoff
+// is zero, and returns how many entries and bytes were removed
+func (c *contentCache) prune(cutoff time.Time) (int, int64, error) {
+	var entries int
+	var size int64
+
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !cutoff.IsZero() && !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		entries++
+		size += info.Size()
+		return nil
+	})
+	return entries, size, err
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pruneCache runs cache prune, removing entries unused for olderThan, or every
+// entry when olderThan is zero
+func pruneCache(dir string, olderThan time.Duration) error {
+	cache := newContentCache(dir)
+	if cache == nil {
+		return fmt.Errorf("No cache directory configured")
+	}
+
+	var cutoff time.Time
+	if olderThan > 0 {
+		cutoff = time.Now().Add(-olderThan)
+	}
+	entries, size, err := cache.prune(cutoff)
+	if err != nil {
+		return fmt.Errorf("Error pruning %s: %v", dir, err)
+	}
+	fmt.Printf("Removed %d cache entries (%d bytes) from %s\n", entries, size, dir)
+	return nil
+}
+
+// parseCacheArgs parses cache prune [--older-than <duration>]
+func parseCacheArgs(args []string) (time.Duration, error) {
+	if len(args) == 0 || args[0] != "prune" {
+		return 0, fmt.Errorf("Unknown cache command")
+	}
+
+	var olderThan time.Duration
+	for i := 1; i < len(args); i++ {
+		if args[i] == "--older-than" && i+1 < len(args) {
+			d, err := parseExpiresAfter(args[i+1])
+			if err != nil {
+				return 0, fmt.Errorf("Invalid value for --older-than: %s", args[i+1])
+			}
+			olderThan = d
+			i++ // skip the duration
+		} else {
+			return 0, fmt.Errorf("Unknown cache argument: %s", args[i])
+		}
+	}
+	return olderThan, nil
+}
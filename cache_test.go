@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+// privateRegistry returns the host of a registry where fetching content from
+// test/private requires the basic credentials user:secret. Pushes and HEAD
+// requests are open so the tests can set up images.
+func privateRegistry(t *testing.T) string {
+	t.Helper()
+
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/test/private/") {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// privateKeychain holds the credentials privateRegistry accepts
+var privateKeychain = staticKeychain{&authn.Basic{Username: "user", Password: "secret"}}
+
+func TestCacheServesManifestsAndConfigs(t *testing.T) {
+	host, blobs := newCountingRegistry(t)
+	repo := host + "/test/cache"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	digest := tagDigest(t, repo+":latest")
+
+	// The tag shares the entries cached for the digest
+	opts := Options{CacheDir: t.TempDir()}
+	for _, tc := range []struct {
+		ref  string
+		want int32
+	}{{repo + "@" + digest, 1}, {repo + ":latest", 0}} {
+		ref, want := tc.ref, tc.want
+		blobs.Store(0)
+		for i := 0; i < 2; i++ {
+			result := testImage(ref, opts)
+			if !result.Success || result.Current["a"] != "b" || result.NewDigest != digest {
+				t.Fatalf("Expected %s to be read, got %+v", ref, result)
+			}
+		}
+		if got := blobs.Load(); got != want {
+			t.Errorf("Expected %d config fetches for %s, got %d", want, ref, got)
+		}
+	}
+
+	blobs.Store(0)
+	testImage(repo+":latest", Options{})
+	if got := blobs.Load(); got != 1 {
+		t.Errorf("Expected the config to be fetched without a cache, got %d", got)
+	}
+}
+
+func TestCacheDiscardsCorruptEntries(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/cache"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	opts := Options{CacheDir: t.TempDir()}
+	testImage(repo+":latest", opts)
+
+	var entries []string
+	filepath.Walk(opts.CacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			entries = append(entries, path)
+		}
+		return nil
+	})
+	if len(entries) != 2 {
+		t.Fatalf("Expected the manifest and config to be cached, got %v", entries)
+	}
+	for _, entry := range entries {
+		if err := os.WriteFile(entry, []byte("application/json\n{}"), 0o644); err != nil {
+			t.Fatalf("Failed to corrupt %s: %v", entry, err)
+		}
+	}
+
+	if result := testImage(repo+":latest", opts); !result.Success || result.Current["a"] != "b" {
+		t.Fatalf("Expected corrupt entries to be refetched, got %+v", result)
+	}
+}
+
+func TestCacheIsScopedToRepository(t *testing.T) {
+	host := privateRegistry(t)
+	pushTestImage(t, host+"/test/private/app:latest", map[string]string{"secret": "label"})
+	digest := tagDigest(t, host+"/test/private/app:latest")
+
+	// Reading the private repository fills the cache
+	opts := Options{CacheDir: t.TempDir()}
+	authorized := opts
+	authorized.Keychain = privateKeychain
+	if result := testImage(host+"/test/private/app@"+digest, authorized); !result.Success {
+		t.Fatalf("Expected the authorized read to succeed, got %+v", result)
+	}
+
+	// The same digest in another repository must come from the registry
+	result := testImage(host+"/test/public/app@"+digest, opts)
+	if result.Success || result.Current["secret"] != "" {
+		t.Errorf("Expected the cached private image not to be served for another repository, got %+v", result)
+	}
+	if result := testImage("other.example.com:1/test/private/app@"+digest, opts); result.Success {
+		t.Errorf("Expected the cached private image not to be served for another registry, got %+v", result)
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	cache := newContentCache(t.TempDir())
+	old := cache.path(cacheEntry{registry: "registry:5000", repository: "org/app", kind: "blobs", hex: sha256Hex([]byte("old"))})
+	recent := cache.path(cacheEntry{registry: "registry:5000", repository: "org/app", kind: "blobs", hex: sha256Hex([]byte("recent"))})
+	cache.write(old, []byte("application/json\nold"))
+	cache.write(recent, []byte("application/json\nrecent"))
+	past := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	entries, size, err := cache.prune(time.Now().Add(-24 * time.Hour))
+	if err != nil || entries != 1 || size != int64(len("application/json\nold")) {
+		t.Errorf("Expected only the old entry to be pruned, got %d entries (%d bytes): %v", entries, size, err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("Expected the recent entry to be kept: %v", err)
+	}
+
+	if entries, _, err := cache.prune(time.Time{}); err != nil || entries != 1 {
+		t.Errorf("Expected every remaining entry to be pruned, got %d: %v", entries, err)
+	}
+}
+
+func TestParseCacheArgs(t *testing.T) {
+	if d, err := parseCacheArgs([]string{"prune", "--older-than", "2w"}); err != nil || d != 14*24*time.Hour {
+		t.Errorf("Unexpected result: %v %v", d, err)
+	}
+	for _, bad := range [][]string{{}, {"clear"}, {"prune", "--older-than", "soon"}, {"prune", "extra"}} {
+		if _, err := parseCacheArgs(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
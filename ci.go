@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Tekton task result names written by --results-dir
+const (
+	resultImageDigest = "IMAGE_DIGEST"
+	resultImageURL    = "IMAGE_URL"
+	resultTaggedAs    = "TAGGED_AS"
+)
+
+// stepOutputs derives the CI step outputs from a successful result, keyed by
+// Tekton result name. A digest reference still names the original image after a
+// mutation, so IMAGE_URL points at the first new tag instead.
+func stepOutputs(result Result) map[string]string {
+	imageURL := result.ImageRef
+	if strings.Contains(imageURL, "@") && len(result.TaggedAs) > 0 {
+		imageURL = result.TaggedAs[0]
+	}
+
+	return map[string]string{
+		resultImageDigest: result.NewDigest,
+		resultImageURL:    imageURL,
+		resultTaggedAs:    strings.Join(result.TaggedAs, ","),
+	}
+}
+
+// writeStepOutputs writes the Tekton results and GitHub Actions outputs
+// requested in opts. Nothing is written for failed results so a later step
+// never picks up a digest that was not pushed.
+func writeStepOutputs(result Result, opts Options) error {
+	if !result.Success {
+		return nil
+	}
+
+	outputs := stepOutputs(result)
+
+	if opts.ResultsDir != "" {
+		if err := writeTektonResults(opts.ResultsDir, outputs); err != nil {
+			return err
+		}
+	}
+
+	if opts.GitHubOutput {
+		path := os.Getenv("GITHUB_OUTPUT")
+		if path == "" {
+			return fmt.Errorf("--github-output requires the GITHUB_OUTPUT environment variable")
+		}
+		if err := appendGitHubOutput(path, outputs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeTektonResults writes one file per result in dir. Tekton keeps trailing
+// whitespace in results, so values are written without a newline.
+func writeTektonResults(dir string, outputs map[string]string) error {
+	for _, key := range sortedKeys(outputs) {
+		path := filepath.Join(dir, key)
+		if err := os.WriteFile(path, []byte(outputs[key]), 0o644); err != nil {
+			return fmt.Errorf("Error writing result %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// appendGitHubOutput appends outputs to the GitHub Actions output file using
+// lower-case names, e.g. image_digest=sha256:...
+func appendGitHubOutput(path string, outputs map[string]string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error opening GITHUB_OUTPUT: %v", err)
+	}
+	defer f.Close()
+
+	for _, key := range sortedKeys(outputs) {
+		if _, err := fmt.Fprintf(f, "%s=%s\n", strings.ToLower(key), outputs[key]); err != nil {
+			return fmt.Errorf("Error writing GITHUB_OUTPUT: %v", err)
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStepOutputsTekton(t *testing.T) {
+	dir := t.TempDir()
+	result := Result{
+		Success:   true,
+		ImageRef:  "quay.io/example/app@sha256:old",
+		NewDigest: "sha256:new",
+		TaggedAs:  []string{"quay.io/example/app:v1", "quay.io/example/app:stable"},
+	}
+
+	if err := writeStepOutputs(result, Options{ResultsDir: dir}); err != nil {
+		t.Fatalf("Failed to write results: %v", err)
+	}
+
+	expected := map[string]string{
+		"IMAGE_DIGEST": "sha256:new",
+		"IMAGE_URL":    "quay.io/example/app:v1",
+		"TAGGED_AS":    "quay.io/example/app:v1,quay.io/example/app:stable",
+	}
+	for name, want := range expected {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to read result %s: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %s to be %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestWriteStepOutputsGitHub(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "github_output")
+	if err := os.WriteFile(path, []byte("existing=value\n"), 0o644); err != nil {
+		t.Fatalf("Failed to seed output file: %v", err)
+	}
+	t.Setenv("GITHUB_OUTPUT", path)
+
+	result := Result{
+		Success:   true,
+		ImageRef:  "quay.io/example/app:latest",
+		NewDigest: "sha256:new",
+	}
+	if err := writeStepOutputs(result, Options{GitHubOutput: true}); err != nil {
+		t.Fatalf("Failed to write outputs: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	want := "existing=value\nimage_digest=sha256:new\nimage_url=quay.io/example/app:latest\ntagged_as=\n"
+	if string(got) != want {
+		t.Errorf("Expected GITHUB_OUTPUT to contain %q, got %q", want, got)
+	}
+}
+
+func TestWriteStepOutputsSkipsFailures(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeStepOutputs(Result{ImageRef: "quay.io/example/app:latest"}, Options{ResultsDir: dir}); err != nil {
+		t.Fatalf("Expected no error for a failed result: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read results dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no results for a failed result, got %d files", len(entries))
+	}
+}
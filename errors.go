@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrorCode classifies a failure so callers can act on it without parsing the error message
+type ErrorCode string
+
+const (
+	ErrInvalidArguments    ErrorCode = "invalid-arguments"
+	ErrInvalidReference    ErrorCode = "invalid-reference"
+	ErrAuthFailed          ErrorCode = "auth-failed"
+	ErrNotFound            ErrorCode = "not-found"
+	ErrDigestRefNeedsTag   ErrorCode = "digest-ref-needs-tag"
+	ErrNothingToChange     ErrorCode = "nothing-to-change"
+	ErrPushDenied          ErrorCode = "push-denied"
+	ErrPreconditionFailed  ErrorCode = "precondition-failed"
+	ErrRegistryUnavailable ErrorCode = "registry-unavailable"
+	ErrRegistryError       ErrorCode = "registry-error"
+	ErrPolicyViolation     ErrorCode = "policy-violation"
+	ErrLintFailed          ErrorCode = "lint-failed"
+	ErrDriftDetected       ErrorCode = "drift-detected"
+	ErrBlobTransfer        ErrorCode = "blob-transfer"
+	ErrInternal            ErrorCode = "internal-error"
+)
+
+// exitCodes maps each ErrorCode to the process exit status. Exit status 1 is
+// kept for internal errors so existing callers that only test for non-zero
+// keep working.
+var exitCodes = map[ErrorCode]int{
+	ErrInternal:            1,
+	ErrInvalidArguments:    2,
+	ErrInvalidReference:    3,
+	ErrAuthFailed:          4,
+	ErrNotFound:            5,
+	ErrDigestRefNeedsTag:   6,
+	ErrNothingToChange:     7,
+	ErrPushDenied:          8,
+	ErrPreconditionFailed:  9,
+	ErrRegistryUnavailable: 10,
+	ErrRegistryError:       11,
+	ErrPolicyViolation:     12,
+	ErrLintFailed:          13,
+	ErrDriftDetected:       14,
+	ErrBlobTransfer:        15,
+}
+
+// exitCode returns the process exit status for code
+func exitCode(code ErrorCode) int {
+	if status, ok := exitCodes[code]; ok {
+		return status
+	}
+	return exitCodes[ErrInternal]
+}
+
+// codedError is an error carrying an ErrorCode
+type codedError struct {
+	code ErrorCode
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// newError returns an error with the given code and formatted message
+func newError(code ErrorCode, format string, args ...interface{}) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code carried by err, or ErrInternal if it has none
+func errorCode(err error) ErrorCode {
+	var cerr *codedError
+	if errors.As(err, &cerr) {
+		return cerr.code
+	}
+	return ErrInternal
+}
+
+// registryErrorCode classifies an error returned by a registry call. denied is
+// the code to use when the registry refuses the operation with 403, which
+// means different things for reads and writes.
+func registryErrorCode(err error, denied ErrorCode) ErrorCode {
+	var cerr *codedError
+	if errors.As(err, &cerr) {
+		return cerr.code
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		switch terr.StatusCode {
+		case http.StatusUnauthorized:
+			return ErrAuthFailed
+		case http.StatusForbidden:
+			return denied
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusPreconditionFailed:
+			return ErrPreconditionFailed
+		}
+
+		for _, diag := range terr.Errors {
+			switch diag.Code {
+			case transport.UnauthorizedErrorCode:
+				return ErrAuthFailed
+			case transport.DeniedErrorCode:
+				return denied
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+				return ErrNotFound
+			}
+		}
+	}
+
+	if isTransient(err) {
+		return ErrRegistryUnavailable
+	}
+	return ErrRegistryError
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestRegistryErrorCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		denied   ErrorCode
+		expected ErrorCode
+	}{
+		{"unauthorized", &transport.Error{StatusCode: http.StatusUnauthorized}, ErrPushDenied, ErrAuthFailed},
+		{"forbidden read", &transport.Error{StatusCode: http.StatusForbidden}, ErrAuthFailed, ErrAuthFailed},
+		{"forbidden write", &transport.Error{StatusCode: http.StatusForbidden}, ErrPushDenied, ErrPushDenied},
+		{"not found", &transport.Error{StatusCode: http.StatusNotFound}, ErrAuthFailed, ErrNotFound},
+		{"precondition", &transport.Error{StatusCode: http.StatusPreconditionFailed}, ErrPushDenied, ErrPreconditionFailed},
+		{"denied diagnostic", &transport.Error{StatusCode: http.StatusBadRequest, Errors: []transport.Diagnostic{{Code: transport.DeniedErrorCode}}}, ErrPushDenied, ErrPushDenied},
+		{"unknown manifest diagnostic", &transport.Error{StatusCode: http.StatusBadRequest, Errors: []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode}}}, ErrAuthFailed, ErrNotFound},
+		{"transient status", &transport.Error{StatusCode: http.StatusBadGateway}, ErrAuthFailed, ErrRegistryUnavailable},
+		{"transient network", fmt.Errorf("reading manifest: %w", io.ErrUnexpectedEOF), ErrAuthFailed, ErrRegistryUnavailable},
+		{"other status", &transport.Error{StatusCode: http.StatusBadRequest}, ErrAuthFailed, ErrRegistryError},
+		{"coded", fmt.Errorf("wrapped: %w", newError(ErrDigestRefNeedsTag, "needs tag")), ErrPushDenied, ErrDigestRefNeedsTag},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := registryErrorCode(tt.err, tt.denied); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestErrorCodeDefaultsToInternal(t *testing.T) {
+	if got := errorCode(errors.New("boom")); got != ErrInternal {
+		t.Errorf("Expected %s for an uncoded error, got %s", ErrInternal, got)
+	}
+
+	if got := errorCode(newError(ErrNothingToChange, "No labels were removed")); got != ErrNothingToChange {
+		t.Errorf("Expected %s, got %s", ErrNothingToChange, got)
+	}
+}
+
+func TestExitCodesAreDistinct(t *testing.T) {
+	seen := make(map[int]ErrorCode)
+	for code, status := range exitCodes {
+		if status == 0 {
+			t.Errorf("Error code %s must not exit with status 0", code)
+		}
+		if other, ok := seen[status]; ok {
+			t.Errorf("Error codes %s and %s share exit status %d", code, other, status)
+		}
+		seen[status] = code
+	}
+
+	if exitCode("unknown") != exitCodes[ErrInternal] {
+		t.Errorf("Expected unknown codes to map to the internal error exit status")
+	}
+}
+
+func TestInvalidTagFailsBeforePush(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/tags"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	before := tagDigest(t, repo+":latest")
+
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, []string{"bad tag!"}, Options{})
+	if result.Success || result.ErrorCode != ErrInvalidReference {
+		t.Fatalf("Expected invalid-reference, got %+v", result)
+	}
+	if tagDigest(t, repo+":latest") != before {
+		t.Error("Expected nothing to be pushed")
+	}
+
+	if got := exitStatus(t, "update-labels", repo+":latest", "a=c", "--tag", "bad tag!"); got != exitCode(ErrInvalidReference) {
+		t.Errorf("Expected exit status %d, got %d", exitCode(ErrInvalidReference), got)
+	}
+}
+
+func TestTagFailureIsNotSuccess(t *testing.T) {
+	host := refusingRegistry(t, pushesTo("/manifests/locked"))
+	repo := host + "/test/tags"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, []string{"locked"}, Options{})
+	if result.Success || result.ErrorCode != ErrPushDenied {
+		t.Fatalf("Expected push-denied, got %+v", result)
+	}
+
+	if got := exitStatus(t, "update-labels", repo+":latest", "a=d", "--tag", "locked"); got != exitCode(ErrPushDenied) {
+		t.Errorf("Expected exit status %d, got %d", exitCode(ErrPushDenied), got)
+	}
+}
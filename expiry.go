@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ExpiryStatus says whether an image has expired
+type ExpiryStatus string
+
+// Expiry statuses reported by expiry-report
+const (
+	ExpiryActive  ExpiryStatus = "active"
+	ExpiryExpired ExpiryStatus = "expired"
+	ExpiryInvalid ExpiryStatus = "invalid"
+	ExpiryNone    ExpiryStatus = "no-expiry"
+	ExpiryUnknown ExpiryStatus = "unknown"
+)
+
+// Expiry describes when an image expires
+type Expiry struct {
+	Status ExpiryStatus `json:"status"`
+	// ExpiresAfter is the quay.expires-after value
+	ExpiresAfter string `json:"expires_after,omitempty"`
+	// ExpiresAt is when Quay garbage collects the tag
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// String summarises the expiry for table output
+func (e *Expiry) String() string {
+	switch e.Status {
+	case ExpiryNone:
+		return "never"
+	case ExpiryInvalid:
+		return fmt.Sprintf("invalid quay.expires-after %q", e.ExpiresAfter)
+	case ExpiryUnknown:
+		return "unknown"
+	case ExpiryExpired:
+		return fmt.Sprintf("%s (expired)", e.ExpiresAt.Format(time.RFC3339))
+	}
+	return e.ExpiresAt.Format(time.RFC3339)
+}
+
+// Labels controlling Quay tag expiry
+const (
+	quayExpiresAfterLabel = "quay.expires-after"
+	// expiryBaseLabel records when label-mod last set quay.expires-after. Quay
+	// counts the expiry from the push, which registries do not report, so the
+	// image creation time is used when label-mod has never set it.
+	expiryBaseLabel = "com.github.brianwcook.label-mod.expiry-base"
+)
+
+// minCreated is the earliest creation time taken at face value. Reproducible
+// builds set the creation time to zero or the epoch, which says nothing about
+// when the tag was pushed.
+var minCreated = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// errUnknownExpiry is returned by imageExpiry when the expiry cannot be computed
+var errUnknownExpiry = errors.New("Cannot tell when the image expires: it has no expiry base and no usable creation time")
+
+// expiresAfterUnits are the duration units Quay accepts in quay.expires-after
+var expiresAfterUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseExpiresAfter parses a quay.expires-after value such as 1h, 2d or 3w
+func parseExpiresAfter(value string) (time.Duration, error) {
+	if len(value) < 2 {
+		return 0, fmt.Errorf("invalid expiry %q", value)
+	}
+	unit, ok := expiresAfterUnits[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid expiry %q: unit must be s, m, h, d or w", value)
+	}
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid expiry %q", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// formatExpiresAfter formats d in the largest unit that divides it exactly
+func formatExpiresAfter(d time.Duration) string {
+	for _, unit := range []byte{'w', 'd', 'h', 'm'} {
+		if size := expiresAfterUnits[unit]; d%size == 0 {
+			return fmt.Sprintf("%d%c", d/size, unit)
+		}
+	}
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+// knownCreated reports whether created is a real creation time
+func knownCreated(created time.Time) bool {
+	return !created.Before(minCreated)
+}
+
+// imageExpiry returns when an image with labels, created at created, expires.
+// ok is false when the image has no quay.expires-after label. err is
+// errUnknownExpiry when there is no expiry base and created is not known.
+func imageExpiry(labels map[string]string, created time.Time) (expires time.Time, ok bool, err error) {
+	value, ok := labels[quayExpiresAfterLabel]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	d, err := parseExpiresAfter(value)
+	if err != nil {
+		return time.Time{}, true, err
+	}
+
+	base := created
+	if since, set := labels[expiryBaseLabel]; set {
+		if base, err = time.Parse(time.RFC3339, since); err != nil {
+			return time.Time{}, true, fmt.Errorf("invalid %s %q", expiryBaseLabel, since)
+		}
+	} else if !knownCreated(created) {
+		return time.Time{}, true, errUnknownExpiry
+	}
+	return base.Add(d), true, nil
+}
+
+// tagExpiry returns when the tag ref, with labels and created at created,
+// expires. Quay reports the expiry of its tags, so its tag API is asked first;
+// for other registries the expiry is computed by imageExpiry. Calls to the
+// tag API are counted in result.
+func tagExpiry(ref string, labels map[string]string, created time.Time, result *Result, opts Options) (expires time.Time, ok bool, err error) {
+	if _, set := labels[quayExpiresAfterLabel]; !set {
+		return time.Time{}, false, nil
+	}
+	if tag, err := name.NewTag(ref); err == nil {
+		if at, found := quayTagExpiry(tag, result, opts); found {
+			if at == nil {
+				return time.Time{}, false, nil
+			}
+			return *at, true, nil
+		}
+	}
+	return imageExpiry(labels, created)
+}
+
+// expiryReport returns a result for every tag of repository saying when it
+// expires as of now. An invalid quay.expires-after value is reported as a
+// warning rather than a failure, so one bad tag does not hide the others.
+func expiryReport(repository string, now time.Time, opts Options) []Result {
+	refs, failure := listMatchingTags(repository, "", opts)
+	if failure.Error != "" {
+		return []Result{failure}
+	}
+
+	results := make([]Result, 0, len(refs))
+	for _, ref := range refs {
+		result, info := inspectImage(ref, opts)
+		if result.Success {
+			labels := result.Current
+			result.Current = nil
+			result.Expiry = &Expiry{Status: ExpiryNone, ExpiresAfter: labels[quayExpiresAfterLabel]}
+
+			expires, ok, err := tagExpiry(ref, labels, info.created, &result, opts)
+			switch {
+			case errors.Is(err, errUnknownExpiry):
+				result.Expiry.Status = ExpiryUnknown
+				result.Warnings = append(result.Warnings, err.Error())
+			case err != nil:
+				result.Expiry.Status = ExpiryInvalid
+				result.Warnings = append(result.Warnings, err.Error())
+			case !ok:
+			case expires.After(now):
+				result.Expiry.Status = ExpiryActive
+				result.Expiry.ExpiresAt = &expires
+			default:
+				result.Expiry.Status = ExpiryExpired
+				result.Expiry.ExpiresAt = &expires
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseExpiresAfter(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"30s": 30 * time.Second,
+		"1h":  time.Hour,
+		"2d":  48 * time.Hour,
+		"3w":  21 * 24 * time.Hour,
+	} {
+		got, err := parseExpiresAfter(value)
+		if err != nil || got != want {
+			t.Errorf("parseExpiresAfter(%q) = %v, %v; want %v", value, got, err, want)
+		}
+		if formatted := formatExpiresAfter(got); formatted != value {
+			t.Errorf("formatExpiresAfter(%v) = %q, want %q", got, formatted, value)
+		}
+	}
+
+	for _, bad := range []string{"", "h", "2y", "-1d", "0w", "1.5d"} {
+		if _, err := parseExpiresAfter(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestImageExpiry(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, ok, _ := imageExpiry(map[string]string{"a": "b"}, created); ok {
+		t.Error("Expected images without quay.expires-after not to expire")
+	}
+
+	expires, ok, err := imageExpiry(map[string]string{quayExpiresAfterLabel: "2d"}, created)
+	if !ok || err != nil || !expires.Equal(created.Add(48*time.Hour)) {
+		t.Errorf("Expected expiry two days after creation, got %v %v %v", expires, ok, err)
+	}
+
+	expires, _, err = imageExpiry(map[string]string{
+		quayExpiresAfterLabel: "1w",
+		expiryBaseLabel:       "2024-02-01T00:00:00Z",
+	}, created)
+	if err != nil || !expires.Equal(time.Date(2024, 2, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected expiry a week after the expiry base, got %v %v", expires, err)
+	}
+
+	if _, ok, err := imageExpiry(map[string]string{quayExpiresAfterLabel: "soon"}, created); !ok || err == nil {
+		t.Error("Expected an invalid expiry to be reported")
+	}
+
+	// Reproducible builds leave the creation time at zero or the epoch
+	for _, unset := range []time.Time{{}, time.Unix(0, 0)} {
+		if _, ok, err := imageExpiry(map[string]string{quayExpiresAfterLabel: "2d"}, unset); !ok || !errors.Is(err, errUnknownExpiry) {
+			t.Errorf("Expected an unknown expiry for creation time %v, got %v %v", unset, ok, err)
+		}
+	}
+	expires, _, err = imageExpiry(map[string]string{
+		quayExpiresAfterLabel: "1w",
+		expiryBaseLabel:       "2024-02-01T00:00:00Z",
+	}, time.Unix(0, 0))
+	if err != nil || !expires.Equal(time.Date(2024, 2, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the expiry base to be used without a creation time, got %v %v", expires, err)
+	}
+}
+
+func TestExpiryReport(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+
+	host := newTestRegistry(t)
+	repo := host + "/test/expiry"
+	pushTestImage(t, repo+":active", map[string]string{quayExpiresAfterLabel: "2d", expiryBaseLabel: "2024-06-10T00:00:00Z"})
+	pushTestImage(t, repo+":expired", map[string]string{quayExpiresAfterLabel: "1h", expiryBaseLabel: "2024-06-10T00:00:00Z"})
+	pushTestImage(t, repo+":invalid", map[string]string{quayExpiresAfterLabel: "soon"})
+	pushTestImage(t, repo+":release", map[string]string{"a": "b"})
+	pushTestImage(t, repo+":unknown", map[string]string{quayExpiresAfterLabel: "1h"})
+
+	results := expiryReport(repo, now, Options{})
+	if len(results) != 5 {
+		t.Fatalf("Expected a result per tag, got %+v", results)
+	}
+
+	byTag := make(map[string]Result)
+	for _, result := range results {
+		if !result.Success || result.Expiry == nil {
+			t.Fatalf("Expected an expiry for every tag, got %+v", result)
+		}
+		byTag[result.ImageRef[len(repo)+1:]] = result
+	}
+
+	if got := byTag["active"].Expiry; got.Status != ExpiryActive || !got.ExpiresAt.Equal(time.Date(2024, 6, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected expiry for active: %+v", got)
+	}
+	if got := byTag["expired"].Expiry; got.Status != ExpiryExpired || got.ExpiresAfter != "1h" {
+		t.Errorf("Unexpected expiry for expired: %+v", got)
+	}
+	if got := byTag["invalid"]; got.Expiry.Status != ExpiryInvalid || len(got.Warnings) != 1 {
+		t.Errorf("Unexpected expiry for invalid: %+v", got)
+	}
+	if got := byTag["release"].Expiry; got.Status != ExpiryNone || got.ExpiresAt != nil {
+		t.Errorf("Unexpected expiry for release: %+v", got)
+	}
+	if got := byTag["unknown"]; got.Expiry.Status != ExpiryUnknown || got.Expiry.ExpiresAt != nil || len(got.Warnings) != 1 {
+		t.Errorf("Expected an image without a creation time not to be reported expired, got %+v", got)
+	}
+}
+
+func TestExpiryReportInvalidRepository(t *testing.T) {
+	results := expiryReport("not a repository", time.Now(), Options{})
+	if len(results) != 1 || results[0].Success || results[0].ErrorCode != ErrInvalidReference {
+		t.Errorf("Expected a single invalid-reference result, got %+v", results)
+	}
+}
@@ -2,7 +2,10 @@ module remove-oci-labels
 
 go 1.21
 
-require github.com/google/go-containerregistry v0.19.0
+require (
+	github.com/google/go-containerregistry v0.19.0
+	sigs.k8s.io/yaml v1.4.0
+)
 
 require (
 	github.com/containerd/stargz-snapshotter/estargz v0.14.3 // indirect
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newTestRegistry starts an in-memory registry and returns its host:port
+func newTestRegistry(t *testing.T, opts ...registry.Option) string {
+	opts = append(opts, registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(registry.New(opts...))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// refusingRegistry starts an in-memory registry that answers every request
+// refuse matches with 403 DENIED and returns its host:port
+func refusingRegistry(t *testing.T, refuse func(*http.Request) bool) string {
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refuse(r) {
+			http.Error(w, `{"errors":[{"code":"DENIED","message":"push refused"}]}`, http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// pushesTo matches manifest pushes whose path ends in suffix, e.g.
+// "/manifests/latest" for one tag or ".sig" for every signature tag
+func pushesTo(suffix string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		return r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") && strings.HasSuffix(r.URL.Path, suffix)
+	}
+}
+
+// pushTestImage pushes a small random image with labels to ref and returns it
+func pushTestImage(t *testing.T, ref string, labels map[string]string) v1.Image {
+	t.Helper()
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	config.Config.Labels = labels
+	img, err = mutate.Config(img, config.Config)
+	if err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", ref, err)
+	}
+	if err := remote.Write(parsed, img); err != nil {
+		t.Fatalf("Failed to push %s: %v", ref, err)
+	}
+	return img
+}
+
+// mustTag parses a tag reference or fails the test
+func mustTag(t *testing.T, ref string) name.Tag {
+	t.Helper()
+
+	tag, err := name.NewTag(ref)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", ref, err)
+	}
+	return tag
+}
+
+// mustDigest parses a digest reference or fails the test
+func mustDigest(t *testing.T, ref string) name.Digest {
+	t.Helper()
+
+	digest, err := name.NewDigest(ref)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", ref, err)
+	}
+	return digest
+}
+
+// tagDigest returns the digest ref currently points at
+func tagDigest(t *testing.T, ref string) string {
+	t.Helper()
+
+	desc, err := remote.Head(mustTag(t, ref))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", ref, err)
+	}
+	return desc.Digest.String()
+}
+
+// exitStatus runs the built binary with args and returns its exit status
+func exitStatus(t *testing.T, args ...string) int {
+	t.Helper()
+
+	err := exec.Command("./bin/label-mod", append(args, "--no-journal", "--no-cache")...).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("Failed to run label-mod: %v", err)
+	}
+	return 0
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Inventory export formats accepted by --format
+const (
+	InventoryCSV   = "csv"
+	InventoryJSONL = "jsonl"
+)
+
+// inventoryLabelPrefix prefixes label columns in CSV exports so labels cannot
+// collide with the fixed columns
+const inventoryLabelPrefix = "label:"
+
+// InventoryRow is a single image in an inventory export. Tags pointing at an
+// image index get a row per platform, with the digest of that platform's image.
+type InventoryRow struct {
+	Repository string            `json:"repository"`
+	Tag        string            `json:"tag"`
+	Digest     string            `json:"digest"`
+	Platform   string            `json:"platform"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// inventoryImage is an image found behind a manifest digest
+type inventoryImage struct {
+	digest   string
+	platform string
+	labels   map[string]string
+}
+
+// inventoryQuery holds the arguments of inventory
+type inventoryQuery struct {
+	Repositories []string
+	Catalog      string
+	Format       string
+	Concurrency  int
+}
+
+// inventory returns a row for every image tagged in the queried repositories,
+// and a failed result for everything that could not be read. Each manifest
+// digest is fetched once, so configs shared by tags or repositories are only
+// downloaded once.
+func inventory(query inventoryQuery, opts Options) ([]InventoryRow, []Result) {
+	repositories := query.Repositories
+	if query.Catalog != "" {
+		var failure Result
+		if repositories, failure = catalogRepositories(query.Catalog, opts); failure.Error != "" {
+			return nil, []Result{failure}
+		}
+	}
+
+	var rows []InventoryRow
+	var failures []Result
+	images := make(map[string][]inventoryImage)
+
+	for _, repository := range repositories {
+		set, failure := resolveTags(repository, query.Concurrency, opts)
+		if set == nil {
+			failures = append(failures, failure)
+			continue
+		}
+
+		var pending []string
+		for _, digest := range set.digests() {
+			if _, seen := images[digest]; !seen {
+				pending = append(pending, digest)
+			}
+		}
+		found := make([][]inventoryImage, len(pending))
+		fetched := make([]Result, len(pending))
+		parallel(len(pending), query.Concurrency, func(i int) {
+			found[i], fetched[i] = fetchInventoryImages(set.repo.Digest(pending[i]), set.auth, opts)
+		})
+		for i, result := range fetched {
+			if !result.Success {
+				failures = append(failures, result)
+				continue
+			}
+			images[pending[i]] = found[i]
+		}
+
+		for _, result := range set.tags {
+			if !result.Success {
+				failures = append(failures, result)
+				continue
+			}
+			tag := result.ImageRef[strings.LastIndex(result.ImageRef, ":")+1:]
+			for _, image := range images[result.NewDigest] {
+				rows = append(rows, InventoryRow{
+					Repository: set.repo.String(),
+					Tag:        tag,
+					Digest:     image.digest,
+					Platform:   image.platform,
+					Labels:     image.labels,
+				})
+			}
+		}
+	}
+
+	return rows, failures
+}
+
+// catalogRepositories lists every repository of registry with the _catalog API
+func catalogRepositories(registry string, opts Options) ([]string, Result) {
+	result := Result{ImageRef: registry}
+
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error parsing registry: %v", err)
+		result.ErrorCode = ErrInvalidReference
+		return nil, result
+	}
+	auth, err := opts.keychain().Resolve(reg)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		result.ErrorCode = ErrAuthFailed
+		return nil, result
+	}
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	var names []string
+	err = retry.do("catalog", func() error {
+		var err error
+		names, err = remote.Catalog(context.Background(), reg, remoteOptions(auth, st)...)
+		return err
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("Error listing repositories: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return nil, result
+	}
+
+	repositories := make([]string, len(names))
+	for i, repository := range names {
+		repositories[i] = reg.Repo(repository).String()
+	}
+	return repositories, result
+}
+
+// fetchInventoryImages fetches the manifest of ref and the config of every
+// image it describes. Index entries without a known platform, such as
+// build attestations, are skipped.
+func fetchInventoryImages(ref name.Digest, auth authn.Authenticator, opts Options) ([]inventoryImage, Result) {
+	result := Result{ImageRef: ref.String()}
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	var images []inventoryImage
+	err := retry.do("fetch", func() error {
+		images = nil
+
+		desc, err := remote.Get(ref, remoteOptions(auth, st)...)
+		if err != nil {
+			return err
+		}
+		if !desc.MediaType.IsIndex() {
+			img, err := desc.Image()
+			if err != nil {
+				return err
+			}
+			image, err := newInventoryImage(img)
+			if err != nil {
+				return err
+			}
+			images = append(images, image)
+			return nil
+		}
+
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, child := range manifest.Manifests {
+			if !child.MediaType.IsImage() || (child.Platform != nil && child.Platform.OS == "unknown") {
+				continue
+			}
+			img, err := idx.Image(child.Digest)
+			if err != nil {
+				return err
+			}
+			image, err := newInventoryImage(img)
+			if err != nil {
+				return err
+			}
+			images = append(images, image)
+		}
+		return nil
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting image: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return nil, result
+	}
+
+	result.Success = true
+	return images, result
+}
+
+// newInventoryImage reads the digest, platform and labels of img
+func newInventoryImage(img v1.Image) (inventoryImage, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return inventoryImage{}, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return inventoryImage{}, err
+	}
+	platform := v1.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	return inventoryImage{digest: digest.String(), platform: platform.String(), labels: config.Config.Labels}, nil
+}
+
+// writeInventory writes rows to w as CSV or JSON Lines. The CSV has a column
+// per label key found in any row, prefixed with "label:".
+func writeInventory(w io.Writer, rows []InventoryRow, format string) error {
+	if format == InventoryJSONL {
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	keySet := make(map[string]string)
+	for _, row := range rows {
+		for key := range row.Labels {
+			keySet[key] = ""
+		}
+	}
+	keys := sortedKeys(keySet)
+
+	cw := csv.NewWriter(w)
+	header := []string{"repository", "tag", "digest", "platform"}
+	for _, key := range keys {
+		header = append(header, inventoryLabelPrefix+key)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := []string{row.Repository, row.Tag, row.Digest, row.Platform}
+		for _, key := range keys {
+			record = append(record, row.Labels[key])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseInventoryArgs parses the arguments of inventory
+func parseInventoryArgs(args []string) (inventoryQuery, error) {
+	query := inventoryQuery{Format: InventoryCSV, Concurrency: defaultListConcurrency}
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--catalog" && i+1 < len(args):
+			query.Catalog = args[i+1]
+			i++ // skip the registry
+		case args[i] == "--format" && i+1 < len(args):
+			query.Format = args[i+1]
+			if query.Format != InventoryCSV && query.Format != InventoryJSONL {
+				return inventoryQuery{}, fmt.Errorf("Invalid value for --format: %s (expected csv or jsonl)", query.Format)
+			}
+			i++ // skip the format
+		case args[i] == "--concurrency" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return inventoryQuery{}, fmt.Errorf("Invalid value for --concurrency: %s", args[i+1])
+			}
+			query.Concurrency = n
+			i++ // skip the limit
+		case !strings.HasPrefix(args[i], "--"):
+			query.Repositories = append(query.Repositories, args[i])
+		default:
+			return inventoryQuery{}, fmt.Errorf("Unknown argument: %s", args[i])
+		}
+	}
+
+	if (query.Catalog == "") == (len(query.Repositories) == 0) {
+		return inventoryQuery{}, fmt.Errorf("Give either repositories or --catalog <registry>")
+	}
+	return query, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// pushTestIndex pushes an index with an image per platform to ref
+func pushTestIndex(t *testing.T, ref string, labels map[string]string, platforms ...v1.Platform) {
+	t.Helper()
+
+	var idx v1.ImageIndex = empty.Index
+	for _, platform := range platforms {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatalf("Failed to create random image: %v", err)
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			t.Fatalf("Failed to read config: %v", err)
+		}
+		config = config.DeepCopy()
+		config.OS, config.Architecture = platform.OS, platform.Architecture
+		config.Config.Labels = labels
+		if img, err = mutate.ConfigFile(img, config); err != nil {
+			t.Fatalf("Failed to set config: %v", err)
+		}
+		platform := platform
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+	}
+
+	if err := remote.WriteIndex(mustTag(t, ref), idx); err != nil {
+		t.Fatalf("Failed to push %s: %v", ref, err)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	host, blobs := newCountingRegistry(t)
+	app := host + "/test/app"
+	img := pushTestImage(t, app+":1.0", map[string]string{"license": "MIT"})
+	if err := remote.Write(mustTag(t, app+":latest"), img); err != nil {
+		t.Fatalf("Failed to tag latest: %v", err)
+	}
+	pushTestIndex(t, host+"/test/multi:1.0", map[string]string{"vendor": "Example"},
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "linux", Architecture: "arm64"})
+	blobs.Store(0)
+
+	rows, failures := inventory(inventoryQuery{Catalog: host, Concurrency: 2}, Options{})
+	if len(failures) != 0 {
+		t.Fatalf("Unexpected failures: %+v", failures)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("Expected two tags of app and two platforms of multi, got %+v", rows)
+	}
+	if got := blobs.Load(); got != 3 {
+		t.Errorf("Expected one config fetch per image, got %d", got)
+	}
+
+	platforms := map[string]bool{}
+	for _, row := range rows {
+		if row.Repository == host+"/test/multi" {
+			platforms[row.Platform] = true
+			if row.Labels["vendor"] != "Example" || row.Tag != "1.0" {
+				t.Errorf("Unexpected row for multi: %+v", row)
+			}
+		} else if row.Labels["license"] != "MIT" || row.Digest != tagDigest(t, app+":1.0") {
+			t.Errorf("Unexpected row for app: %+v", row)
+		}
+	}
+	if !platforms["linux/amd64"] || !platforms["linux/arm64"] {
+		t.Errorf("Expected a row per platform, got %v", platforms)
+	}
+
+	var out bytes.Buffer
+	if err := writeInventory(&out, rows, InventoryCSV); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	if got := strings.Join(records[0], ","); got != "repository,tag,digest,platform,label:license,label:vendor" {
+		t.Errorf("Unexpected CSV header: %s", got)
+	}
+	if len(records) != 5 {
+		t.Errorf("Expected a CSV record per row, got %d", len(records)-1)
+	}
+
+	out.Reset()
+	if err := writeInventory(&out, rows[:1], InventoryJSONL); err != nil {
+		t.Fatalf("Failed to write JSON Lines: %v", err)
+	}
+	var row InventoryRow
+	if err := json.Unmarshal(out.Bytes(), &row); err != nil || row.Digest != rows[0].Digest {
+		t.Errorf("Unexpected JSON Lines output %q: %v", out.String(), err)
+	}
+}
+
+func TestInventoryReportsUnreadableRepositories(t *testing.T) {
+	host := newTestRegistry(t)
+	pushTestImage(t, host+"/test/app:1.0", map[string]string{"license": "MIT"})
+
+	rows, failures := inventory(inventoryQuery{Repositories: []string{host + "/test/app", host + "/test/missing"}, Concurrency: 1}, Options{})
+	if len(rows) != 1 {
+		t.Errorf("Expected the readable repository to be exported, got %+v", rows)
+	}
+	if len(failures) != 1 || failures[0].ErrorCode != ErrNotFound {
+		t.Errorf("Expected not-found for the missing repository, got %+v", failures)
+	}
+}
+
+func TestParseInventoryArgs(t *testing.T) {
+	query, err := parseInventoryArgs([]string{"quay.io/org/a", "quay.io/org/b", "--format", "jsonl"})
+	if err != nil || len(query.Repositories) != 2 || query.Format != InventoryJSONL {
+		t.Errorf("Unexpected query: %+v %v", query, err)
+	}
+
+	for _, bad := range [][]string{
+		{},
+		{"quay.io/org/a", "--catalog", "quay.io"},
+		{"quay.io/org/a", "--format", "xml"},
+	} {
+		if _, err := parseInventoryArgs(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
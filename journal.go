@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Kinds of journal entry
+const (
+	OperationMutate = "mutate"
+	OperationUndo   = "undo"
+)
+
+// Operation is one line of the journal: a set of tags moved from OldDigest to NewDigest
+type Operation struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Time      time.Time `json:"time"`
+	ImageRef  string    `json:"image_ref"`
+	Tags      []string  `json:"tags"`
+	OldDigest string    `json:"old_digest"`
+	NewDigest string    `json:"new_digest"`
+	// Before is the digest each tag had before the operation, "" when it did
+	// not exist. Tags not listed were at OldDigest.
+	Before map[string]string `json:"before,omitempty"`
+	// After is the digest each tag was left at, "" when it was deleted. Tags
+	// not listed were moved to NewDigest.
+	After map[string]string `json:"after,omitempty"`
+	// Undoes is the operation reverted by an undo entry
+	Undoes string `json:"undoes,omitempty"`
+}
+
+// before returns the digest tag had before op, "" when it did not exist
+func (op Operation) before(tag string) string {
+	if digest, ok := op.Before[tag]; ok {
+		return digest
+	}
+	return op.OldDigest
+}
+
+// after returns the digest op left tag at, "" when it deleted the tag
+func (op Operation) after(tag string) string {
+	if digest, ok := op.After[tag]; ok {
+		return digest
+	}
+	return op.NewDigest
+}
+
+// defaultJournalPath returns $XDG_STATE_HOME/label-mod/journal.jsonl, falling
+// back to ~/.local/state when XDG_STATE_HOME is not set
+func defaultJournalPath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "label-mod", "journal.jsonl")
+}
+
+// newOperationID returns a short random operation identifier
+func newOperationID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405")
+	}
+	return hex.EncodeToString(b)
+}
+
+// appendOperation appends op to the journal at path as a single JSON line
+func appendOperation(path string, op Operation) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readJournal returns every operation in the journal at path, oldest first. A
+// missing journal holds no operations.
+func readJournal(path string) ([]Operation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var ops []Operation
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var op Operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return nil, fmt.Errorf("Error parsing %s line %d: %v", path, line, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+// movedTags returns the tags a mutation of ref pointed at its new digest
+func movedTags(ref name.Reference, taggedAs []string) []string {
+	var tags []string
+	if tag, ok := ref.(name.Tag); ok {
+		tags = append(tags, tag.String())
+	}
+	for _, tag := range taggedAs {
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// recordOperation journals the tags result moved and stores the operation ID
+// in result. before holds the previous digest of tags that were not at
+// result.OldDigest, "" for tags that did not exist. The registry has already
+// changed at this point, so a journal failure is reported as a warning rather
+// than failing the command.
+func recordOperation(result *Result, ref name.Reference, before map[string]string, opts Options) {
+	if opts.Journal == "" {
+		return
+	}
+	tags := movedTags(ref, result.TaggedAs)
+	if len(tags) == 0 {
+		return
+	}
+
+	op := Operation{
+		ID:        newOperationID(),
+		Kind:      OperationMutate,
+		Time:      time.Now().UTC(),
+		ImageRef:  result.ImageRef,
+		Tags:      tags,
+		OldDigest: result.OldDigest,
+		NewDigest: result.NewDigest,
+	}
+	for _, tag := range tags {
+		if digest, ok := before[tag]; ok && digest != result.OldDigest {
+			if op.Before == nil {
+				op.Before = make(map[string]string)
+			}
+			op.Before[tag] = digest
+		}
+	}
+	if err := appendOperation(opts.Journal, op); err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Could not record operation in %s: %v", opts.Journal, err))
+		return
+	}
+	result.Operation = op.ID
+}
+
+// findOperation returns the operation with id, or the most recent mutation not
+// yet undone when id is empty
+func findOperation(ops []Operation, id string) (Operation, error) {
+	undone := make(map[string]bool)
+	for _, op := range ops {
+		if op.Kind == OperationUndo {
+			undone[op.Undoes] = true
+		}
+	}
+
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if id != "" && op.ID != id {
+			continue
+		}
+		if id == "" && (op.Kind != OperationMutate || undone[op.ID]) {
+			continue
+		}
+		if undone[op.ID] {
+			return Operation{}, newError(ErrNothingToChange, "Operation %s has already been undone", op.ID)
+		}
+		return op, nil
+	}
+
+	if id == "" {
+		return Operation{}, newError(ErrNothingToChange, "No operations to undo")
+	}
+	return Operation{}, newError(ErrInvalidArguments, "Unknown operation: %s", id)
+}
+
+// undoOperation repoints every tag moved by the operation id (the latest one
+// when empty) back to the digest it had before, deleting tags the operation
+// created. Tags that have moved again since are left alone and reported as
+// warnings. The undo is only journaled once every tag has
+// been handled, so an undo that fails partway can be run again.
+func undoOperation(id string, opts Options) Result {
+	result := Result{}
+
+	if opts.Journal == "" {
+		result.Error = "undo requires a journal"
+		result.ErrorCode = ErrInvalidArguments
+		return result
+	}
+
+	ops, err := readJournal(opts.Journal)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error reading journal: %v", err)
+		result.ErrorCode = ErrInternal
+		return result
+	}
+	op, err := findOperation(ops, id)
+	if err != nil {
+		result.Error = err.Error()
+		result.ErrorCode = errorCode(err)
+		return result
+	}
+
+	result.ImageRef = op.ImageRef
+	result.OldDigest = op.NewDigest
+	result.NewDigest = op.OldDigest
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	undo := Operation{
+		ID:        newOperationID(),
+		Kind:      OperationUndo,
+		ImageRef:  op.ImageRef,
+		OldDigest: op.NewDigest,
+		NewDigest: op.OldDigest,
+		Undoes:    op.ID,
+	}
+	// restored records a tag put back to where it was before op
+	restored := func(tagRef string) {
+		undo.Tags = append(undo.Tags, tagRef)
+		want, restore := op.after(tagRef), op.before(tagRef)
+		if restore == "" {
+			result.DeletedTags = append(result.DeletedTags, tagRef)
+		} else {
+			result.TaggedAs = append(result.TaggedAs, tagRef)
+		}
+		if want != op.NewDigest || restore != op.OldDigest {
+			if undo.Before == nil {
+				undo.Before, undo.After = make(map[string]string), make(map[string]string)
+			}
+			undo.Before[tagRef], undo.After[tagRef] = want, restore
+		}
+	}
+
+	for _, tagRef := range op.Tags {
+		tag, err := name.NewTag(tagRef)
+		if err != nil {
+			result.Error = fmt.Sprintf("Error parsing tag %s: %v", tagRef, err)
+			result.ErrorCode = ErrInvalidReference
+			return result
+		}
+
+		auth, err := opts.keychain().Resolve(tag.Context())
+		if err != nil {
+			result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+			result.ErrorCode = ErrAuthFailed
+			return result
+		}
+		remoteOpts := remoteOptions(auth, st)
+
+		// Only move the tag back if nobody has moved it since
+		want, restore := op.after(tagRef), op.before(tagRef)
+		current, err := currentDigest(tag, retry, remoteOpts)
+		if err != nil {
+			result.Error = fmt.Sprintf("Error getting tag %s: %v", tagRef, err)
+			result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+			return result
+		}
+		if current == restore && current != want {
+			// Already restored, e.g. by an undo that failed partway
+			restored(tagRef)
+			continue
+		}
+		if current != want {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s now points at %s, not %s; left alone", tagRef, digestOrNothing(current), digestOrNothing(want)))
+			continue
+		}
+
+		// Tags the operation created are deleted rather than left at its old digest
+		err = retry.do("tag", func() error {
+			if restore == "" {
+				return remote.Delete(tag, remoteOpts...)
+			}
+			desc, err := remote.Get(tag.Context().Digest(restore), remoteOpts...)
+			if err != nil {
+				return err
+			}
+			return remote.Put(tag, desc, remoteOpts...)
+		})
+		if err != nil {
+			result.Error = fmt.Sprintf("Error restoring %s: %v", tagRef, err)
+			result.ErrorCode = registryErrorCode(err, ErrPushDenied)
+			break
+		}
+		restored(tagRef)
+	}
+
+	if len(undo.Tags) == 0 {
+		if result.Error == "" {
+			err := newError(ErrPreconditionFailed, "No tag of operation %s still points at %s", op.ID, op.NewDigest)
+			result.Error = err.Error()
+			result.ErrorCode = errorCode(err)
+		}
+		return result
+	}
+	if result.Error != "" {
+		// Leave the operation open so running undo again can finish it
+		return result
+	}
+
+	undo.Time = time.Now().UTC()
+	if err := appendOperation(opts.Journal, undo); err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Could not record operation in %s: %v", opts.Journal, err))
+	} else {
+		result.Operation = undo.ID
+	}
+	result.Success = true
+
+	return result
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestJournalRecordsMutations(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/journal"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	opts := Options{Journal: filepath.Join(t.TempDir(), "state", "journal.jsonl")}
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, []string{"v1"}, opts)
+	if !result.Success || result.Operation == "" {
+		t.Fatalf("Expected the operation to be journaled, got %+v", result)
+	}
+
+	ops, err := readJournal(opts.Journal)
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+	if len(ops) != 1 {
+		t.Fatalf("Expected 1 operation, got %+v", ops)
+	}
+	op := ops[0]
+	if op.ID != result.Operation || op.Kind != OperationMutate || op.OldDigest != result.OldDigest || op.NewDigest != result.NewDigest {
+		t.Errorf("Unexpected operation %+v", op)
+	}
+	if len(op.Tags) != 2 || op.Tags[0] != repo+":latest" || op.Tags[1] != repo+":v1" {
+		t.Errorf("Expected the source tag and the new tag, got %v", op.Tags)
+	}
+
+	if result := updateLabels(repo+":latest", map[string]string{"a": "d"}, nil, Options{}); result.Operation != "" {
+		t.Errorf("Expected no journal without a path, got %s", result.Operation)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/undo"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	opts := Options{Journal: filepath.Join(t.TempDir(), "journal.jsonl")}
+
+	first := updateLabels(repo+":latest", map[string]string{"a": "c"}, []string{"v1"}, opts)
+	if !first.Success {
+		t.Fatalf("Update failed: %+v", first)
+	}
+
+	// Move v1 elsewhere so undo has to leave it alone
+	pushTestImage(t, repo+":v1", map[string]string{"other": "image"})
+	moved := tagDigest(t, repo+":v1")
+
+	result := undoOperation("", opts)
+	if !result.Success {
+		t.Fatalf("Undo failed: %+v", result)
+	}
+	if len(result.TaggedAs) != 1 || result.TaggedAs[0] != repo+":latest" {
+		t.Errorf("Expected only latest to be repointed, got %v", result.TaggedAs)
+	}
+	if len(result.Warnings) != 1 {
+		t.Errorf("Expected a warning for the moved tag, got %v", result.Warnings)
+	}
+	if got := tagDigest(t, repo+":latest"); got != first.OldDigest {
+		t.Errorf("Expected latest back at %s, got %s", first.OldDigest, got)
+	}
+	if got := tagDigest(t, repo+":v1"); got != moved {
+		t.Errorf("Expected v1 to be left at %s, got %s", moved, got)
+	}
+
+	if result := undoOperation("", opts); result.ErrorCode != ErrNothingToChange {
+		t.Errorf("Expected nothing left to undo, got %+v", result)
+	}
+	if result := undoOperation(first.Operation, opts); result.ErrorCode != ErrNothingToChange {
+		t.Errorf("Expected an undone operation to be refused, got %+v", result)
+	}
+	if result := undoOperation("nope", opts); result.ErrorCode != ErrInvalidArguments {
+		t.Errorf("Expected unknown operations to be rejected, got %+v", result)
+	}
+}
+
+func TestUndoRefusesMovedTags(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/undo"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	opts := Options{Journal: filepath.Join(t.TempDir(), "journal.jsonl")}
+
+	first := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, opts)
+	second := updateLabels(repo+":latest", map[string]string{"a": "d"}, nil, opts)
+	if !first.Success || !second.Success {
+		t.Fatalf("Updates failed: %+v %+v", first, second)
+	}
+
+	result := undoOperation(first.Operation, opts)
+	if result.Success || result.ErrorCode != ErrPreconditionFailed {
+		t.Errorf("Expected precondition-failed, got %+v", result)
+	}
+	if got := tagDigest(t, repo+":latest"); got != second.NewDigest {
+		t.Errorf("Expected latest to stay at %s, got %s", second.NewDigest, got)
+	}
+}
+
+func TestPartialUndoCanBeFinished(t *testing.T) {
+	// A registry that refuses pushes to v1 while locked
+	var locked atomic.Bool
+	lockedV1 := pushesTo("/manifests/v1")
+	repo := refusingRegistry(t, func(r *http.Request) bool {
+		return locked.Load() && lockedV1(r)
+	}) + "/test/undo"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	pushTestImage(t, repo+":v1", map[string]string{"a": "v1"})
+	v1 := tagDigest(t, repo+":v1")
+	opts := Options{Journal: filepath.Join(t.TempDir(), "journal.jsonl")}
+
+	first := updateLabels(repo+":latest", map[string]string{"a": "c"}, []string{"v1"}, opts)
+	if !first.Success {
+		t.Fatalf("Update failed: %+v", first)
+	}
+
+	locked.Store(true)
+	partial := undoOperation(first.Operation, opts)
+	if partial.Success || partial.ErrorCode != ErrPushDenied {
+		t.Fatalf("Expected push-denied, got %+v", partial)
+	}
+	if partial.Operation != "" {
+		t.Errorf("Expected a partial undo not to be journaled, got %s", partial.Operation)
+	}
+	if got := tagDigest(t, repo+":latest"); got != first.OldDigest {
+		t.Errorf("Expected latest back at %s, got %s", first.OldDigest, got)
+	}
+
+	locked.Store(false)
+	result := undoOperation(first.Operation, opts)
+	if !result.Success || result.Operation == "" {
+		t.Fatalf("Expected the undo to finish, got %+v", result)
+	}
+	if len(result.TaggedAs) != 2 || len(result.Warnings) != 0 {
+		t.Errorf("Expected both tags to be recorded without warnings, got %v %v", result.TaggedAs, result.Warnings)
+	}
+	if got := tagDigest(t, repo+":v1"); got != v1 {
+		t.Errorf("Expected v1 back at its own previous digest %s, got %s", v1, got)
+	}
+	if result := undoOperation(first.Operation, opts); result.ErrorCode != ErrNothingToChange {
+		t.Errorf("Expected the finished undo to be recorded, got %+v", result)
+	}
+}
+
+func TestUndoDeletesCreatedTags(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/undo"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	pushTestImage(t, repo+":stable", map[string]string{"a": "stable"})
+	stable := tagDigest(t, repo+":stable")
+	opts := Options{Journal: filepath.Join(t.TempDir(), "journal.jsonl")}
+
+	first := updateLabels(repo+":latest", map[string]string{"a": "c"}, []string{"new", "stable"}, opts)
+	if !first.Success {
+		t.Fatalf("Update failed: %+v", first)
+	}
+
+	result := undoOperation(first.Operation, opts)
+	if !result.Success {
+		t.Fatalf("Undo failed: %+v", result)
+	}
+	if len(result.DeletedTags) != 1 || result.DeletedTags[0] != repo+":new" {
+		t.Errorf("Expected the created tag to be deleted, got %v", result.DeletedTags)
+	}
+	if _, err := remote.Head(mustTag(t, repo+":new")); err == nil {
+		t.Error("Expected new not to exist after undo")
+	}
+	if got := tagDigest(t, repo+":stable"); got != stable {
+		t.Errorf("Expected stable back at %s, got %s", stable, got)
+	}
+	if got := tagDigest(t, repo+":latest"); got != first.OldDigest {
+		t.Errorf("Expected latest back at %s, got %s", first.OldDigest, got)
+	}
+
+	// Undoing the undo moves every tag forward again
+	redo := undoOperation(result.Operation, opts)
+	if !redo.Success || len(redo.Warnings) != 0 {
+		t.Fatalf("Expected the undo to be undone, got %+v", redo)
+	}
+	for _, tag := range []string{"latest", "new", "stable"} {
+		if got := tagDigest(t, repo+":"+tag); got != first.NewDigest {
+			t.Errorf("Expected %s at %s, got %s", tag, first.NewDigest, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// KeepaliveConfig lists the tags keepalive keeps from expiring
+type KeepaliveConfig struct {
+	// Interval between scans, e.g. 1h
+	Interval string `json:"interval"`
+	// Threshold is how close to expiry a tag must be to get extended, e.g. 24h
+	Threshold string `json:"threshold"`
+	// MaxExtension caps the extend of every rule, e.g. 14d
+	MaxExtension string          `json:"max_extension"`
+	Rules        []KeepaliveRule `json:"rules"`
+
+	interval     time.Duration
+	threshold    time.Duration
+	maxExtension time.Duration
+}
+
+// KeepaliveRule extends tags of Repository matching the Tags glob (every tag
+// when empty). With KeepTagsFile only tags listed in that file, one per line,
+// are kept alive; it is read again on every scan. Tags of images older than
+// MaxAge are left to expire.
+type KeepaliveRule struct {
+	Repository   string `json:"repository"`
+	Tags         string `json:"tags,omitempty"`
+	KeepTagsFile string `json:"keep_tags_file,omitempty"`
+	Extend       string `json:"extend"`
+	MaxAge       string `json:"max_age,omitempty"`
+
+	extend time.Duration
+	maxAge time.Duration
+}
+
+// loadKeepaliveConfig reads and validates a keepalive configuration file
+func loadKeepaliveConfig(path string) (*KeepaliveConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config KeepaliveConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+
+	durations := []struct {
+		field string
+		value string
+		into  *time.Duration
+	}{
+		{"interval", config.Interval, &config.interval},
+		{"threshold", config.Threshold, &config.threshold},
+		{"max_extension", config.MaxExtension, &config.maxExtension},
+	}
+	for _, d := range durations {
+		if *d.into, err = parseExpiresAfter(d.value); err != nil {
+			return nil, fmt.Errorf("%s: %v", d.field, err)
+		}
+	}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Repository == "" {
+			return nil, fmt.Errorf("rules[%d] needs a repository", i)
+		}
+		if rule.extend, err = parseExpiresAfter(rule.Extend); err != nil {
+			return nil, fmt.Errorf("rules[%d].extend: %v", i, err)
+		}
+		if rule.extend > config.maxExtension {
+			return nil, fmt.Errorf("rules[%d].extend %s exceeds max_extension %s", i, rule.Extend, config.MaxExtension)
+		}
+		if rule.MaxAge != "" {
+			if rule.maxAge, err = parseExpiresAfter(rule.MaxAge); err != nil {
+				return nil, fmt.Errorf("rules[%d].max_age: %v", i, err)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// readKeepTags reads the tags listed in path, ignoring blank lines and # comments
+func readKeepTags(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tags := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tags[line] = true
+		}
+	}
+	return tags, scanner.Err()
+}
+
+// keepaliveScan extends every tag covered by config that expires within the
+// threshold of now, and returns a result per extension or failure. Tags
+// without quay.expires-after never expire and are skipped.
+func keepaliveScan(config *KeepaliveConfig, now time.Time, opts Options) []Result {
+	var results []Result
+
+	for _, rule := range config.Rules {
+		var keep map[string]bool
+		if rule.KeepTagsFile != "" {
+			var err error
+			if keep, err = readKeepTags(rule.KeepTagsFile); err != nil {
+				results = append(results, Result{
+					ImageRef:  rule.Repository,
+					Error:     fmt.Sprintf("Error reading %s: %v", rule.KeepTagsFile, err),
+					ErrorCode: ErrInvalidArguments,
+				})
+				continue
+			}
+		}
+
+		refs, failure := listMatchingTags(rule.Repository, rule.Tags, opts)
+		if failure.Error != "" {
+			results = append(results, failure)
+			continue
+		}
+
+		for _, ref := range refs {
+			if keep != nil && !keep[ref[strings.LastIndex(ref, ":")+1:]] {
+				continue
+			}
+			if result := keepalive(ref, rule, config.threshold, now, opts); result != nil {
+				results = append(results, *result)
+			}
+		}
+	}
+
+	return results
+}
+
+// keepalive extends ref if it expires within threshold of now. It returns nil
+// when there is nothing to do.
+func keepalive(ref string, rule KeepaliveRule, threshold time.Duration, now time.Time, opts Options) *Result {
+	current, info := inspectImage(ref, opts)
+	if !current.Success {
+		return &current
+	}
+
+	expires, ok, err := tagExpiry(ref, current.Current, info.created, &current, opts)
+	if !ok {
+		return nil
+	}
+	// An unknown expiry may be close, so extend it; that also records an expiry base
+	unknown := errors.Is(err, errUnknownExpiry)
+	if err != nil && !unknown {
+		current.Success = false
+		current.Error = fmt.Sprintf("Cannot tell when %s expires: %v", ref, err)
+		current.ErrorCode = ErrInvalidArguments
+		return &current
+	}
+	if !unknown && expires.Sub(now) > threshold {
+		return nil
+	}
+	if rule.maxAge > 0 && knownCreated(info.created) && now.Sub(info.created) > rule.maxAge {
+		return nil
+	}
+
+	opts.ExpectDigest = current.OldDigest
+	result := updateLabels(ref, map[string]string{
+		quayExpiresAfterLabel: formatExpiresAfter(rule.extend),
+		expiryBaseLabel:       now.UTC().Format(time.RFC3339),
+	}, nil, opts)
+	if unknown {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Extended %s because its expiry is unknown", ref))
+	}
+	return &result
+}
+
+// runKeepalive scans every interval until SIGINT or SIGTERM, or once when once
+// is set, writing a result per extension to w
+func runKeepalive(config *KeepaliveConfig, once bool, w io.Writer, opts Options) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ticker := time.NewTicker(config.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, result := range keepaliveScan(config, time.Now(), opts) {
+			metrics.observeOperation("keepalive", result)
+			if err := writeResult(w, result, opts.Output); err != nil {
+				return err
+			}
+		}
+		if once {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseKeepaliveArgs returns the configuration file and whether --once was given
+func parseKeepaliveArgs(args []string) (string, bool) {
+	configPath := ""
+	once := false
+
+	for _, arg := range args {
+		if arg == "--once" {
+			once = true
+		} else if configPath == "" {
+			configPath = arg
+		}
+	}
+
+	return configPath, once
+}
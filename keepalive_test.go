@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadKeepaliveConfigValidation(t *testing.T) {
+	for _, bad := range []string{
+		"interval: 1h\nthreshold: 1d\nmax_extension: 1w\nrules:\n- extend: 1d\n",
+		"interval: 1h\nthreshold: 1d\nmax_extension: 1w\nrules:\n- repository: quay.io/org/app\n  extend: 2w\n",
+		"interval: 1h\nthreshold: 1d\nmax_extension: 1w\nrules:\n- repository: quay.io/org/app\n  extend: 1y\n",
+		"interval: 1h\nthreshold: 1d\nrules:\n- repository: quay.io/org/app\n  extend: 1d\n",
+		"interval: 1h\nthreshold: 1d\nmax_extension: 1w\nrules:\n- repository: quay.io/org/app\n  extend: 1d\n  keep: x\n",
+	} {
+		if _, err := loadKeepaliveConfig(writeDesiredState(t, bad)); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestKeepaliveScan(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	base := func(d time.Duration) string { return now.Add(-d).Format(time.RFC3339) }
+
+	host := newTestRegistry(t)
+	repo := host + "/test/keepalive"
+	pushTestImage(t, repo+":pr-1", map[string]string{quayExpiresAfterLabel: "1w", expiryBaseLabel: base(6*24*time.Hour + 12*time.Hour)})
+	pushTestImage(t, repo+":pr-2", map[string]string{quayExpiresAfterLabel: "1w", expiryBaseLabel: base(6*24*time.Hour + 12*time.Hour)})
+	pushTestImage(t, repo+":pr-3", map[string]string{quayExpiresAfterLabel: "1w", expiryBaseLabel: base(time.Hour)})
+	pushTestImage(t, repo+":release", map[string]string{"a": "b"})
+	fresh := tagDigest(t, repo+":pr-3")
+
+	keepFile := filepath.Join(t.TempDir(), "open-prs.txt")
+	if err := os.WriteFile(keepFile, []byte("# open pull requests\npr-1\npr-3\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write keep file: %v", err)
+	}
+
+	config, err := loadKeepaliveConfig(writeDesiredState(t, `
+interval: 1h
+threshold: 1d
+max_extension: 2w
+rules:
+- repository: `+repo+`
+  keep_tags_file: `+keepFile+`
+  extend: 1w
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	results := keepaliveScan(config, now, Options{})
+	if len(results) != 1 {
+		t.Fatalf("Expected only pr-1 to be extended, got %+v", results)
+	}
+	if !results[0].Success || results[0].ImageRef != repo+":pr-1" {
+		t.Fatalf("Expected pr-1 to be extended, got %+v", results[0])
+	}
+	if got := results[0].Updated[expiryBaseLabel]; got != now.Format(time.RFC3339) {
+		t.Errorf("Expected the expiry base to be reset to now, got %q", got)
+	}
+	if tagDigest(t, repo+":pr-1") != results[0].NewDigest {
+		t.Error("Expected pr-1 to point at the extended image")
+	}
+	if tagDigest(t, repo+":pr-3") != fresh {
+		t.Error("Expected pr-3 to be left alone")
+	}
+
+	if results := keepaliveScan(config, now, Options{}); len(results) != 0 {
+		t.Errorf("Expected nothing to extend on the next scan, got %+v", results)
+	}
+}
+
+func TestKeepaliveScanReportsMissingKeepFile(t *testing.T) {
+	config := &KeepaliveConfig{Rules: []KeepaliveRule{{
+		Repository:   "quay.io/org/app",
+		KeepTagsFile: filepath.Join(t.TempDir(), "missing.txt"),
+	}}}
+
+	results := keepaliveScan(config, time.Now(), Options{})
+	if len(results) != 1 || results[0].Success || results[0].ErrorCode != ErrInvalidArguments {
+		t.Errorf("Expected a failed result for the missing keep file, got %+v", results)
+	}
+}
+
+func TestKeepaliveExtendsUnknownExpiry(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+
+	host := newTestRegistry(t)
+	repo := host + "/test/keepalive"
+	// The test images have no creation time, like reproducible builds
+	pushTestImage(t, repo+":pr-1", map[string]string{quayExpiresAfterLabel: "1w"})
+
+	config, err := loadKeepaliveConfig(writeDesiredState(t, `
+interval: 1h
+threshold: 1d
+max_extension: 2w
+rules:
+- repository: `+repo+`
+  extend: 1w
+  max_age: 4w
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	results := keepaliveScan(config, now, Options{})
+	if len(results) != 1 || !results[0].Success || len(results[0].Warnings) != 1 {
+		t.Fatalf("Expected pr-1 to be extended with a warning, got %+v", results)
+	}
+	if got := results[0].Updated[expiryBaseLabel]; got != now.Format(time.RFC3339) {
+		t.Errorf("Expected the expiry base to be set, got %q", got)
+	}
+	if results := keepaliveScan(config, now, Options{}); len(results) != 0 {
+		t.Errorf("Expected the expiry to be known on the next scan, got %+v", results)
+	}
+}
@@ -540,8 +540,8 @@ func TestLabelModErrorHandling(t *testing.T) {
 	}
 
 	// Test removing non-existent label
-	output, err := runCommand("remove-labels", imageRef, "nonexistent-label")
-	if err == nil {
+	output, runErr := runCommand("remove-labels", imageRef, "nonexistent-label")
+	if runErr == nil {
 		t.Error("Expected error when removing non-existent label")
 	}
 
@@ -561,6 +561,14 @@ func TestLabelModErrorHandling(t *testing.T) {
 	if !strings.Contains(result.Error, "No labels were removed") {
 		t.Errorf("Expected error about no labels removed, got: %s", result.Error)
 	}
+
+	if result.ErrorCode != ErrNothingToChange {
+		t.Errorf("Expected error_code %s, got: %s", ErrNothingToChange, result.ErrorCode)
+	}
+
+	if exitErr, ok := runErr.(*exec.ExitError); ok && exitErr.ExitCode() != exitCode(ErrNothingToChange) {
+		t.Errorf("Expected exit status %d, got %d", exitCode(ErrNothingToChange), exitErr.ExitCode())
+	}
 }
 
 func TestLabelModInvalidCommands(t *testing.T) {
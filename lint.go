@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Severity of a lint finding, using the SARIF level names
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityNote    Severity = "note"
+)
+
+// Built-in lint rule sets selectable with --rules
+const (
+	RuleSetOCI         = "oci"
+	RuleSetLabelSchema = "label-schema"
+	RuleSetRedHat      = "redhat"
+)
+
+// defaultRuleSets apply when --rules is not given. The Red Hat certification
+// labels only make sense for images submitted for certification, so that set
+// has to be asked for.
+var defaultRuleSets = []string{RuleSetOCI, RuleSetLabelSchema}
+
+// Finding is a single lint rule broken by an image's labels
+type Finding struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Label    string   `json:"label"`
+	Message  string   `json:"message"`
+}
+
+// lintRule checks labels and returns a finding for every label breaking it,
+// keyed by label with the message as value
+type lintRule struct {
+	ID          string
+	Set         string
+	Severity    Severity
+	Description string
+	check       func(labels map[string]string) map[string]string
+}
+
+// ociAnnotationKeys are the pre-defined annotation keys of the OCI image spec
+var ociAnnotationKeys = []string{
+	"org.opencontainers.image.created",
+	"org.opencontainers.image.authors",
+	"org.opencontainers.image.url",
+	"org.opencontainers.image.documentation",
+	"org.opencontainers.image.source",
+	"org.opencontainers.image.version",
+	"org.opencontainers.image.revision",
+	"org.opencontainers.image.vendor",
+	"org.opencontainers.image.licenses",
+	"org.opencontainers.image.ref.name",
+	"org.opencontainers.image.title",
+	"org.opencontainers.image.description",
+	"org.opencontainers.image.base.digest",
+	"org.opencontainers.image.base.name",
+}
+
+// labelSchemaReplacements maps the deprecated label-schema.org keys to the OCI
+// keys that replaced them. Keys without an OCI equivalent are not listed.
+var labelSchemaReplacements = map[string]string{
+	"org.label-schema.build-date":  "org.opencontainers.image.created",
+	"org.label-schema.name":        "org.opencontainers.image.title",
+	"org.label-schema.description": "org.opencontainers.image.description",
+	"org.label-schema.usage":       "org.opencontainers.image.documentation",
+	"org.label-schema.url":         "org.opencontainers.image.url",
+	"org.label-schema.vcs-url":     "org.opencontainers.image.source",
+	"org.label-schema.vcs-ref":     "org.opencontainers.image.revision",
+	"org.label-schema.vendor":      "org.opencontainers.image.vendor",
+	"org.label-schema.version":     "org.opencontainers.image.version",
+}
+
+const labelSchemaPrefix = "org.label-schema."
+
+// redHatRequiredLabels must be set on images submitted for Red Hat container certification
+var redHatRequiredLabels = []string{
+	"name",
+	"vendor",
+	"version",
+	"release",
+	"summary",
+	"description",
+	"maintainer",
+	"com.redhat.component",
+}
+
+// redHatRecommendedLabels are shown by the Red Hat catalog and OpenShift console
+var redHatRecommendedLabels = []string{
+	"url",
+	"io.k8s.display-name",
+	"io.k8s.description",
+}
+
+// lintRules lists every built-in rule in the order findings are reported
+var lintRules = []lintRule{
+	{
+		ID:          "oci/created-format",
+		Set:         RuleSetOCI,
+		Severity:    SeverityError,
+		Description: "org.opencontainers.image.created must be an RFC 3339 date-time",
+		check: func(labels map[string]string) map[string]string {
+			key := "org.opencontainers.image.created"
+			value, ok := labels[key]
+			if !ok {
+				return nil
+			}
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				return map[string]string{key: fmt.Sprintf("%q is not an RFC 3339 date-time", value)}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "oci/url-format",
+		Set:         RuleSetOCI,
+		Severity:    SeverityWarning,
+		Description: "OCI url, documentation and source labels should be absolute URLs",
+		check: func(labels map[string]string) map[string]string {
+			findings := map[string]string{}
+			for _, key := range []string{"org.opencontainers.image.url", "org.opencontainers.image.documentation", "org.opencontainers.image.source"} {
+				value, ok := labels[key]
+				if !ok {
+					continue
+				}
+				if u, err := url.Parse(value); err != nil || !u.IsAbs() || u.Host == "" {
+					findings[key] = fmt.Sprintf("%q is not an absolute URL", value)
+				}
+			}
+			return findings
+		},
+	},
+	{
+		ID:          "oci/base-digest-format",
+		Set:         RuleSetOCI,
+		Severity:    SeverityError,
+		Description: "org.opencontainers.image.base.digest must be a digest",
+		check: func(labels map[string]string) map[string]string {
+			key := "org.opencontainers.image.base.digest"
+			value, ok := labels[key]
+			if !ok {
+				return nil
+			}
+			if _, err := v1.NewHash(value); err != nil {
+				return map[string]string{key: fmt.Sprintf("%q is not a digest", value)}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "oci/unknown-key",
+		Set:         RuleSetOCI,
+		Severity:    SeverityWarning,
+		Description: "Labels in the org.opencontainers.image namespace should be pre-defined OCI keys",
+		check: func(labels map[string]string) map[string]string {
+			findings := map[string]string{}
+			for key := range labels {
+				if strings.HasPrefix(key, "org.opencontainers.image.") && !containsString(ociAnnotationKeys, key) {
+					findings[key] = fmt.Sprintf("%s is not a pre-defined OCI annotation key", key)
+				}
+			}
+			return findings
+		},
+	},
+	{
+		ID:          "oci/empty-value",
+		Set:         RuleSetOCI,
+		Severity:    SeverityWarning,
+		Description: "Pre-defined OCI labels should not be empty",
+		check: func(labels map[string]string) map[string]string {
+			findings := map[string]string{}
+			for _, key := range ociAnnotationKeys {
+				if value, ok := labels[key]; ok && strings.TrimSpace(value) == "" {
+					findings[key] = fmt.Sprintf("%s is empty", key)
+				}
+			}
+			return findings
+		},
+	},
+	{
+		ID:          "oci/recommended",
+		Set:         RuleSetOCI,
+		Severity:    SeverityNote,
+		Description: "Images should record when and from which source revision they were built",
+		check: func(labels map[string]string) map[string]string {
+			findings := map[string]string{}
+			for _, key := range []string{"org.opencontainers.image.created", "org.opencontainers.image.source", "org.opencontainers.image.revision"} {
+				if _, ok := labels[key]; !ok {
+					findings[key] = fmt.Sprintf("%s is not set", key)
+				}
+			}
+			return findings
+		},
+	},
+	{
+		ID:          "label-schema/deprecated",
+		Set:         RuleSetLabelSchema,
+		Severity:    SeverityWarning,
+		Description: "The label-schema.org keys are deprecated in favour of the OCI annotation keys",
+		check: func(labels map[string]string) map[string]string {
+			findings := map[string]string{}
+			for key := range labels {
+				if !strings.HasPrefix(key, labelSchemaPrefix) {
+					continue
+				}
+				if replacement, ok := labelSchemaReplacements[key]; ok {
+					findings[key] = fmt.Sprintf("%s is deprecated, use %s", key, replacement)
+				} else {
+					findings[key] = fmt.Sprintf("%s is deprecated and has no OCI equivalent", key)
+				}
+			}
+			return findings
+		},
+	},
+	{
+		ID:          "label-schema/conflict",
+		Set:         RuleSetLabelSchema,
+		Severity:    SeverityError,
+		Description: "A label-schema.org key and its OCI replacement must not disagree",
+		check: func(labels map[string]string) map[string]string {
+			findings := map[string]string{}
+			for key, replacement := range labelSchemaReplacements {
+				old, ok := labels[key]
+				if !ok {
+					continue
+				}
+				if value, ok := labels[replacement]; ok && value != old {
+					findings[key] = fmt.Sprintf("%s is %q but %s is %q", key, old, replacement, value)
+				}
+			}
+			return findings
+		},
+	},
+	{
+		ID:          "redhat/required",
+		Set:         RuleSetRedHat,
+		Severity:    SeverityError,
+		Description: "Labels required for Red Hat container certification",
+		check: func(labels map[string]string) map[string]string {
+			return missingLabels(labels, redHatRequiredLabels)
+		},
+	},
+	{
+		ID:          "redhat/recommended",
+		Set:         RuleSetRedHat,
+		Severity:    SeverityWarning,
+		Description: "Labels shown by the Red Hat catalog and OpenShift console",
+		check: func(labels map[string]string) map[string]string {
+			return missingLabels(labels, redHatRecommendedLabels)
+		},
+	},
+}
+
+// missingLabels returns a finding for each of keys that is unset or empty
+func missingLabels(labels map[string]string, keys []string) map[string]string {
+	findings := map[string]string{}
+	for _, key := range keys {
+		if strings.TrimSpace(labels[key]) == "" {
+			findings[key] = fmt.Sprintf("%s is required", key)
+		}
+	}
+	return findings
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRuleSets validates the rule set names given with --rules
+func parseRuleSets(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return defaultRuleSets, nil
+	}
+	for _, set := range names {
+		switch set {
+		case RuleSetOCI, RuleSetLabelSchema, RuleSetRedHat:
+		default:
+			return nil, fmt.Errorf("Unknown rule set: %s (expected %s, %s or %s)", set, RuleSetOCI, RuleSetLabelSchema, RuleSetRedHat)
+		}
+	}
+	return names, nil
+}
+
+// lintLabels runs the rules of ruleSets against labels
+func lintLabels(labels map[string]string, ruleSets []string) []Finding {
+	var findings []Finding
+	for _, rule := range lintRules {
+		if !containsString(ruleSets, rule.Set) {
+			continue
+		}
+		broken := rule.check(labels)
+		for _, label := range sortedKeys(broken) {
+			findings = append(findings, Finding{
+				Rule:     rule.ID,
+				Severity: rule.Severity,
+				Label:    label,
+				Message:  broken[label],
+			})
+		}
+	}
+	return findings
+}
+
+// lintImage checks the labels of an existing image against the built-in rule
+// sets and the policy in opts. It fails when the policy is broken or any
+// finding has error severity; warnings and notes are only reported.
+func lintImage(imageRef string, ruleSetNames []string, opts Options) Result {
+	ruleSets, err := parseRuleSets(ruleSetNames)
+	if err != nil {
+		return Result{
+			ImageRef:  imageRef,
+			Error:     err.Error(),
+			ErrorCode: ErrInvalidArguments,
+		}
+	}
+
+	var policy *Policy
+	if opts.PolicyFile != "" {
+		policy, err = loadPolicy(opts.PolicyFile)
+		if err != nil {
+			return Result{
+				ImageRef:  imageRef,
+				Error:     fmt.Sprintf("Error loading policy: %v", err),
+				ErrorCode: ErrInvalidArguments,
+			}
+		}
+	}
+
+	result := testImage(imageRef, opts)
+	if !result.Success {
+		return result
+	}
+
+	result.Findings = lintLabels(result.Current, ruleSets)
+
+	if policy != nil {
+		// testImage has already parsed the reference successfully
+		ref, _ := name.ParseReference(imageRef)
+		result.Violations = policy.evaluate(ref.Context().Name(), result.Current, result.Current)
+		if len(result.Violations) > 0 {
+			err := policyError(result.Violations)
+			result.Success = false
+			result.Error = err.Error()
+			result.ErrorCode = errorCode(err)
+			return result
+		}
+	}
+
+	var errors []string
+	for _, finding := range result.Findings {
+		if finding.Severity == SeverityError {
+			errors = append(errors, fmt.Sprintf("%s: %s", finding.Rule, finding.Message))
+		}
+	}
+	if len(errors) > 0 {
+		err := newError(ErrLintFailed, "Lint failed: %s", strings.Join(errors, "; "))
+		result.Success = false
+		result.Error = err.Error()
+		result.ErrorCode = errorCode(err)
+	}
+
+	return result
+}
+
+// parseLintArgs returns the rule sets given with --rules, which may be
+// repeated or hold a comma-separated list
+func parseLintArgs(args []string) []string {
+	var ruleSets []string
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--rules" && i+1 < len(args) {
+			ruleSets = append(ruleSets, strings.Split(args[i+1], ",")...)
+			i++ // skip the rule sets
+		}
+	}
+
+	return ruleSets
+}
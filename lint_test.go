@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// findingRules returns the rule and label of each finding as "rule label"
+func findingRules(findings []Finding) map[string]Severity {
+	rules := make(map[string]Severity, len(findings))
+	for _, finding := range findings {
+		rules[finding.Rule+" "+finding.Label] = finding.Severity
+	}
+	return rules
+}
+
+func TestLintLabels(t *testing.T) {
+	labels := map[string]string{
+		"org.opencontainers.image.created":     "yesterday",
+		"org.opencontainers.image.source":      "github.com/org/repo",
+		"org.opencontainers.image.revison":     "abc123",
+		"org.opencontainers.image.title":       "",
+		"org.label-schema.vcs-ref":             "abc123",
+		"org.label-schema.schema-version":      "1.0",
+		"org.label-schema.version":             "1.0",
+		"org.opencontainers.image.version":     "2.0",
+		"org.opencontainers.image.base.digest": "sha256:nope",
+	}
+
+	got := findingRules(lintLabels(labels, defaultRuleSets))
+	want := map[string]Severity{
+		"oci/created-format org.opencontainers.image.created":         SeverityError,
+		"oci/url-format org.opencontainers.image.source":              SeverityWarning,
+		"oci/base-digest-format org.opencontainers.image.base.digest": SeverityError,
+		"oci/unknown-key org.opencontainers.image.revison":            SeverityWarning,
+		"oci/empty-value org.opencontainers.image.title":              SeverityWarning,
+		"oci/recommended org.opencontainers.image.revision":           SeverityNote,
+		"label-schema/deprecated org.label-schema.vcs-ref":            SeverityWarning,
+		"label-schema/deprecated org.label-schema.schema-version":     SeverityWarning,
+		"label-schema/deprecated org.label-schema.version":            SeverityWarning,
+		"label-schema/conflict org.label-schema.version":              SeverityError,
+	}
+	for key, severity := range want {
+		if got[key] != severity {
+			t.Errorf("Expected %s with severity %s, got %q", key, severity, got[key])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d findings, got %v", len(want), got)
+	}
+
+	for key := range findingRules(lintLabels(labels, []string{RuleSetRedHat})) {
+		if key[:7] != "redhat/" {
+			t.Errorf("Expected only Red Hat rules, got %s", key)
+		}
+	}
+}
+
+func TestLintRedHatLabels(t *testing.T) {
+	labels := map[string]string{
+		"name":                 "ubi9/app",
+		"vendor":               "Example",
+		"version":              "1.0",
+		"release":              "3",
+		"summary":              "An app",
+		"description":          "An app",
+		"maintainer":           "team@example.com",
+		"com.redhat.component": "app-container",
+	}
+
+	got := findingRules(lintLabels(labels, []string{RuleSetRedHat}))
+	for key, severity := range got {
+		if severity != SeverityWarning {
+			t.Errorf("Expected only recommended labels to be reported, got %s", key)
+		}
+	}
+
+	delete(labels, "release")
+	got = findingRules(lintLabels(labels, []string{RuleSetRedHat}))
+	if got["redhat/required release"] != SeverityError {
+		t.Errorf("Expected missing release to be an error, got %v", got)
+	}
+}
+
+func TestParseRuleSets(t *testing.T) {
+	if sets := parseLintArgs([]string{"--rules", "oci,redhat", "--rules", "label-schema"}); len(sets) != 3 {
+		t.Errorf("Expected 3 rule sets, got %v", sets)
+	}
+	if sets, err := parseRuleSets(nil); err != nil || len(sets) != len(defaultRuleSets) {
+		t.Errorf("Expected the default rule sets, got %v, %v", sets, err)
+	}
+	if _, err := parseRuleSets([]string{"docker"}); err == nil {
+		t.Error("Expected unknown rule sets to be rejected")
+	}
+}
+
+func TestLintImage(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/lint"
+	pushTestImage(t, repo+":warn", map[string]string{"org.label-schema.vcs-ref": "abc123"})
+	pushTestImage(t, repo+":bad", map[string]string{"org.opencontainers.image.created": "yesterday"})
+
+	result := lintImage(repo+":warn", nil, Options{})
+	if !result.Success || len(result.Findings) == 0 {
+		t.Errorf("Expected warnings to be reported without failing, got %+v", result)
+	}
+
+	result = lintImage(repo+":bad", nil, Options{})
+	if result.Success || result.ErrorCode != ErrLintFailed {
+		t.Errorf("Expected lint-failed for an error finding, got %+v", result)
+	}
+
+	result = lintImage(repo+":missing", nil, Options{})
+	if result.ErrorCode != ErrNotFound {
+		t.Errorf("Expected not-found for a missing tag, got %+v", result)
+	}
+}
+
+func TestWriteResultSARIF(t *testing.T) {
+	result := Result{
+		Success:   false,
+		Error:     "Lint failed",
+		ErrorCode: ErrLintFailed,
+		ImageRef:  "quay.io/org/app:latest",
+		NewDigest: "sha256:abc",
+		Findings: []Finding{{
+			Rule:     "oci/created-format",
+			Severity: SeverityError,
+			Label:    "org.opencontainers.image.created",
+			Message:  "not a date",
+		}},
+		Violations: []PolicyViolation{{Rule: "release", Kind: ViolationRequired, Label: "version", Message: "label version is required"}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeResult(&buf, result, OutputFormat{Kind: OutputSARIF}); err != nil {
+		t.Fatalf("Failed to write SARIF: %v", err)
+	}
+
+	var log sarifReport
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("Failed to parse SARIF: %v", err)
+	}
+	if log.Version != sarifVersion || len(log.Runs) != 1 {
+		t.Fatalf("Unexpected SARIF log: %s", buf.String())
+	}
+	run := log.Runs[0]
+	if len(run.Results) != 2 || run.Results[1].RuleID != "policy/release" {
+		t.Errorf("Expected the finding and the violation, got %+v", run.Results)
+	}
+	if name := run.Results[0].Locations[0].LogicalLocations[0].FullyQualifiedName; name != "quay.io/org/app:latest#org.opencontainers.image.created" {
+		t.Errorf("Unexpected location %s", name)
+	}
+	if !run.Invocations[0].ExecutionSuccessful {
+		t.Error("Expected broken rules to count as a successful run")
+	}
+	if len(run.Tool.Driver.Rules) != len(lintRules)+1 {
+		t.Errorf("Expected every built-in rule and the policy rule, got %d", len(run.Tool.Driver.Rules))
+	}
+}
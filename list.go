@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// defaultListConcurrency is how many registry requests ls and find make at once
+const defaultListConcurrency = 8
+
+// labelMatcher selects images whose label Key equals Value, or matches Pattern
+// when it is set
+type labelMatcher struct {
+	Key     string
+	Value   string
+	Pattern *regexp.Regexp
+}
+
+// parseLabelMatcher parses key=value or key~regex
+func parseLabelMatcher(arg string) (labelMatcher, error) {
+	i := strings.IndexAny(arg, "=~")
+	if i <= 0 {
+		return labelMatcher{}, fmt.Errorf("Invalid label match %q (expected key=value or key~regex)", arg)
+	}
+
+	matcher := labelMatcher{Key: arg[:i], Value: arg[i+1:]}
+	if arg[i] == '~' {
+		pattern, err := regexp.Compile(matcher.Value)
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("Invalid label match %q: %v", arg, err)
+		}
+		matcher.Pattern = pattern
+	}
+	return matcher, nil
+}
+
+// matches reports whether labels satisfy the matcher. A missing label never matches.
+func (m labelMatcher) matches(labels map[string]string) bool {
+	value, ok := labels[m.Key]
+	if !ok {
+		return false
+	}
+	if m.Pattern != nil {
+		return m.Pattern.MatchString(value)
+	}
+	return value == m.Value
+}
+
+// listQuery holds the arguments of ls and find
+type listQuery struct {
+	Repository  string
+	Labels      []string
+	Matchers    []labelMatcher
+	Concurrency int
+}
+
+// parallel calls fn for 0..n-1 with at most limit calls running at once
+func parallel(n, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// tagSet is the tags of a repository resolved to digests
+type tagSet struct {
+	repo name.Repository
+	auth authn.Authenticator
+	// tags holds a result per tag with its digest in NewDigest
+	tags []Result
+}
+
+// digests returns the distinct digests of the resolved tags
+func (s *tagSet) digests() []string {
+	var digests []string
+	seen := make(map[string]bool)
+	for _, result := range s.tags {
+		if result.Success && !seen[result.NewDigest] {
+			seen[result.NewDigest] = true
+			digests = append(digests, result.NewDigest)
+		}
+	}
+	return digests
+}
+
+// resolveTags lists the tags of repository and resolves each with a HEAD request
+func resolveTags(repository string, concurrency int, opts Options) (*tagSet, Result) {
+	refs, failure := listMatchingTags(repository, "", opts)
+	if failure.Error != "" {
+		return nil, failure
+	}
+	repo, _ := name.NewRepository(repository)
+	auth, err := opts.keychain().Resolve(repo)
+	if err != nil {
+		failure.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		failure.ErrorCode = ErrAuthFailed
+		return nil, failure
+	}
+
+	set := &tagSet{repo: repo, auth: auth, tags: make([]Result, len(refs))}
+	parallel(len(refs), concurrency, func(i int) {
+		set.tags[i] = headTag(refs[i], auth, opts)
+	})
+	return set, failure
+}
+
+// tagLabels returns a result for every tag of repository with its digest in
+// NewDigest and its labels in Current, like testImage. Tags are resolved with
+// HEAD requests and each config is fetched once per digest, so tags sharing
+// an image share the fetch.
+func tagLabels(repository string, concurrency int, opts Options) []Result {
+	set, failure := resolveTags(repository, concurrency, opts)
+	if set == nil {
+		return []Result{failure}
+	}
+	results := set.tags
+
+	digests := set.digests()
+	fetched := make([]Result, len(digests))
+	parallel(len(digests), concurrency, func(i int) {
+		fetched[i] = fetchLabels(set.repo.Digest(digests[i]), set.auth, opts)
+	})
+	configs := make(map[string]*Result)
+	for i := range digests {
+		configs[digests[i]] = &fetched[i]
+	}
+
+	for i, result := range results {
+		if !result.Success {
+			continue
+		}
+		config := configs[result.NewDigest]
+		// The attempts and traffic of a shared fetch are only counted once, on
+		// the first tag
+		for step, attempts := range config.Attempts {
+			results[i].Attempts[step] += attempts
+		}
+		results[i].Transfer = results[i].Transfer.add(config.Transfer)
+		config.Attempts, config.Transfer = nil, nil
+		if !config.Success {
+			results[i].Success = false
+			results[i].Error = config.Error
+			results[i].ErrorCode = config.ErrorCode
+			results[i].HTTPStatus = config.HTTPStatus
+			results[i].Transient = config.Transient
+			continue
+		}
+		results[i].Current = config.Current
+	}
+	return results
+}
+
+// headTag resolves the digest of a tag with a HEAD request
+func headTag(imageRef string, auth authn.Authenticator, opts Options) Result {
+	result := Result{ImageRef: imageRef}
+
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
+		result.ErrorCode = ErrInvalidReference
+		return result
+	}
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	err = retry.do("head", func() error {
+		desc, err := remote.Head(ref, remoteOptions(auth, st)...)
+		if err == nil {
+			result.NewDigest = desc.Digest.String()
+		}
+		return err
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting digest: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return result
+	}
+
+	result.Success = true
+	return result
+}
+
+// fetchLabels fetches the config of ref and returns its labels in Current
+func fetchLabels(ref name.Digest, auth authn.Authenticator, opts Options) Result {
+	result := Result{ImageRef: ref.String()}
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	_, config, err := fetchImage(ref, retry, remoteOptions(auth, st))
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting image: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return result
+	}
+
+	result.Current = config.Config.Labels
+	result.Success = true
+	return result
+}
+
+// listTags returns every tag of the repository with its digest and labels,
+// keeping only the labels in query.Labels when any are given
+func listTags(query listQuery, opts Options) []Result {
+	results := tagLabels(query.Repository, query.Concurrency, opts)
+	if len(query.Labels) == 0 {
+		return results
+	}
+
+	for i := range results {
+		selected := make(map[string]string)
+		for _, key := range query.Labels {
+			if value, ok := results[i].Current[key]; ok {
+				selected[key] = value
+			}
+		}
+		results[i].Current = selected
+	}
+	return results
+}
+
+// findTags returns the tags of the repository whose labels satisfy every
+// matcher, along with any tags that could not be read
+func findTags(query listQuery, opts Options) []Result {
+	var found []Result
+	for _, result := range listTags(listQuery{Repository: query.Repository, Concurrency: query.Concurrency}, opts) {
+		if result.Success && !matchesAll(query.Matchers, result.Current) {
+			continue
+		}
+		found = append(found, result)
+	}
+	return found
+}
+
+// matchesAll reports whether labels satisfy every matcher
+func matchesAll(matchers []labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseListArgs parses the arguments of ls and find
+func parseListArgs(args []string) (listQuery, error) {
+	query := listQuery{Concurrency: defaultListConcurrency}
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--labels" && i+1 < len(args):
+			query.Labels = append(query.Labels, strings.Split(args[i+1], ",")...)
+			i++ // skip the keys
+		case args[i] == "--label" && i+1 < len(args):
+			matcher, err := parseLabelMatcher(args[i+1])
+			if err != nil {
+				return listQuery{}, err
+			}
+			query.Matchers = append(query.Matchers, matcher)
+			i++ // skip the match
+		case args[i] == "--concurrency" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return listQuery{}, fmt.Errorf("Invalid value for --concurrency: %s", args[i+1])
+			}
+			query.Concurrency = n
+			i++ // skip the limit
+		case query.Repository == "" && !strings.HasPrefix(args[i], "--"):
+			query.Repository = args[i]
+		default:
+			return listQuery{}, fmt.Errorf("Unknown argument: %s", args[i])
+		}
+	}
+
+	return query, nil
+}
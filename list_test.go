@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestParseLabelMatcher(t *testing.T) {
+	exact, err := parseLabelMatcher("team=a=b")
+	if err != nil || exact.Key != "team" || exact.Value != "a=b" || exact.Pattern != nil {
+		t.Errorf("Unexpected exact matcher: %+v %v", exact, err)
+	}
+	if !exact.matches(map[string]string{"team": "a=b"}) || exact.matches(map[string]string{"team": "a"}) {
+		t.Error("Expected exact matchers to compare the whole value")
+	}
+
+	pattern, err := parseLabelMatcher("version~^1\\.")
+	if err != nil || pattern.Key != "version" || pattern.Pattern == nil {
+		t.Errorf("Unexpected regex matcher: %+v %v", pattern, err)
+	}
+	if !pattern.matches(map[string]string{"version": "1.2"}) || pattern.matches(map[string]string{}) {
+		t.Error("Expected regex matchers to match existing values only")
+	}
+
+	for _, bad := range []string{"team", "=a", "version~("} {
+		if _, err := parseLabelMatcher(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// newCountingRegistry starts a test registry that counts blob downloads
+func newCountingRegistry(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+
+	var blobs atomic.Int32
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobs.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), &blobs
+}
+
+func TestListTagsSharesFetchesByDigest(t *testing.T) {
+	host, blobs := newCountingRegistry(t)
+	repo := host + "/test/ls"
+	img := pushTestImage(t, repo+":1.0", map[string]string{"version": "1.0", "team": "a"})
+	for _, tag := range []string{"latest", "stable"} {
+		if err := remote.Write(mustTag(t, repo+":"+tag), img); err != nil {
+			t.Fatalf("Failed to tag %s: %v", tag, err)
+		}
+	}
+	pushTestImage(t, repo+":2.0", map[string]string{"version": "2.0", "team": "b"})
+	blobs.Store(0)
+
+	results := listTags(listQuery{Repository: repo, Labels: []string{"version"}, Concurrency: 4}, Options{})
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 tags, got %+v", results)
+	}
+	for _, result := range results {
+		if !result.Success || result.NewDigest == "" {
+			t.Fatalf("Expected every tag to be listed, got %+v", result)
+		}
+		if len(result.Current) != 1 || result.Current["version"] == "" {
+			t.Errorf("Expected only the selected label, got %v", result.Current)
+		}
+	}
+	if got := blobs.Load(); got != 2 {
+		t.Errorf("Expected one config fetch per digest, got %d", got)
+	}
+
+	// A shared fetch is counted on one tag, not on every tag at its digest
+	fetches := 0
+	for _, result := range results {
+		fetches += result.Attempts["fetch"]
+	}
+	if fetches != 2 {
+		t.Errorf("Expected one fetch attempt per digest across the tags, got %d", fetches)
+	}
+}
+
+func TestFindTags(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/find"
+	pushTestImage(t, repo+":1.0", map[string]string{"version": "1.0", "team": "a"})
+	pushTestImage(t, repo+":1.1", map[string]string{"version": "1.1", "team": "b"})
+	pushTestImage(t, repo+":2.0", map[string]string{"version": "2.0", "team": "a"})
+
+	query, err := parseListArgs([]string{repo, "--label", "team=a", "--label", "version~^1\\."})
+	if err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	results := findTags(query, Options{})
+	if len(results) != 1 || results[0].ImageRef != repo+":1.0" {
+		t.Fatalf("Expected only 1.0 to match, got %+v", results)
+	}
+	if results[0].Current["team"] != "a" || results[0].NewDigest == "" {
+		t.Errorf("Expected the match to carry its digest and labels, got %+v", results[0])
+	}
+}
+
+func TestParseListArgs(t *testing.T) {
+	query, err := parseListArgs([]string{"quay.io/org/app", "--labels", "a,b", "--concurrency", "2"})
+	if err != nil || query.Repository != "quay.io/org/app" || len(query.Labels) != 2 || query.Concurrency != 2 {
+		t.Errorf("Unexpected query: %+v %v", query, err)
+	}
+
+	for _, bad := range [][]string{
+		{"quay.io/org/app", "--concurrency", "0"},
+		{"quay.io/org/app", "--label", "nokey"},
+		{"quay.io/org/app", "extra"},
+	} {
+		if _, err := parseListArgs(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
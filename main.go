@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -13,6 +15,12 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// userAgent identifies label-mod to registries
+var userAgent = "label-mod/" + version
+
 type Config struct {
 	Registry     string
 	Username     string
@@ -25,31 +33,176 @@ type Config struct {
 }
 
 type Result struct {
+	SchemaVersion string `json:"schema_version"`
+
 	Success   bool              `json:"success"`
 	Error     string            `json:"error,omitempty"`
+	ErrorCode ErrorCode         `json:"error_code,omitempty"`
 	ImageRef  string            `json:"image_ref"`
 	OldDigest string            `json:"old_digest,omitempty"`
 	NewDigest string            `json:"new_digest,omitempty"`
 	Removed   []string          `json:"removed,omitempty"`
 	Updated   map[string]string `json:"updated,omitempty"`
 	Current   map[string]string `json:"current,omitempty"`
+	Previous  map[string]string `json:"previous,omitempty"`
 	TaggedAs  []string          `json:"tagged_as,omitempty"`
+
+	// Attempts counts registry calls per step (fetch, push, tag), including retries
+	Attempts map[string]int `json:"attempts,omitempty"`
+	// HTTPStatus is the registry response status of the last failed call
+	HTTPStatus int `json:"http_status,omitempty"`
+	// Transient is set when the failure was retryable but attempts ran out
+	Transient bool `json:"transient,omitempty"`
+
+	// Referrers lists the signatures, attestations and other artifacts attached to OldDigest
+	Referrers []Referrer `json:"referrers,omitempty"`
+	// Warnings are problems that did not stop the operation
+	Warnings []string `json:"warnings,omitempty"`
+
+	// SignatureTag and SignatureDigest identify the cosign signature pushed with --sign-key
+	SignatureTag    string `json:"signature_tag,omitempty"`
+	SignatureDigest string `json:"signature_digest,omitempty"`
+
+	// Provenance is the digest reference of the label change attestation pushed with --provenance
+	Provenance string `json:"provenance,omitempty"`
+
+	// Violations lists the policy rules the labels break
+	Violations []PolicyViolation `json:"violations,omitempty"`
+
+	// Findings lists the lint rules the labels break
+	Findings []Finding `json:"findings,omitempty"`
+
+	// Migrated lists the label-schema.org labels rewritten by migrate-labels
+	Migrated []MigratedLabel `json:"migrated,omitempty"`
+
+	// Operation is the journal ID of the change, for use with undo
+	Operation string `json:"operation,omitempty"`
+
+	// Annotations are the manifest annotations set by reconcile
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Drift lists the differences from the desired state found by reconcile
+	Drift []Drift `json:"drift,omitempty"`
+
+	// RolledBack lists the tags moved back to their previous digest when a batch failed
+	RolledBack []string `json:"rolled_back,omitempty"`
+	// DeletedTags lists the tags undo removed because the operation created them
+	DeletedTags []string `json:"deleted_tags,omitempty"`
+
+	// Expiry reports when the image expires under quay.expires-after
+	Expiry *Expiry `json:"expiry,omitempty"`
+
+	// Transfer counts the registry requests made and bytes moved
+	Transfer *Transfer `json:"transfer,omitempty"`
+
+	// DroppedFields lists the config fields a relabel without --raw-config loses
+	DroppedFields []string `json:"dropped_fields,omitempty"`
+}
+
+// Options holds the global flags shared by every command
+type Options struct {
+	Retry  RetryPolicy
+	Output OutputFormat
+
+	// ResultsDir is the Tekton results directory to write step outputs to
+	ResultsDir string
+	// GitHubOutput appends step outputs to the file named by $GITHUB_OUTPUT
+	GitHubOutput bool
+	// CopyReferrers re-attaches attestations and SBOMs of the old digest to the new one
+	CopyReferrers bool
+	// SignKey is the path of a private key used to sign the new digest
+	SignKey string
+	// Provenance pushes an in-toto statement describing the change, attached to the new digest
+	Provenance bool
+	// PolicyFile is the label policy checked before every push and by lint
+	PolicyFile string
+	// Journal is the file every mutation is recorded in for undo; empty disables it
+	Journal string
+	// DryRun computes the new digest without pushing anything, for plan
+	DryRun bool
+	// ExpectDigest refuses the change unless the image is still at this digest, for apply
+	ExpectDigest string
+	// ExpectTagDigests refuses the change unless each listed --tag target is
+	// still at its digest, or still missing when the digest is empty, for apply
+	ExpectTagDigests map[string]string
+	// Stage pushes the new manifest by digest without moving any tag, for batch
+	Stage bool
+	// RawConfig edits the labels inside the original config bytes instead of
+	// re-encoding the config with mutate.Config
+	RawConfig bool
+	// StrictNoBlobs fails any operation that would download or upload a layer
+	StrictNoBlobs bool
+	// CacheDir holds manifests and configs by digest; empty disables the cache
+	CacheDir string
+	// Keychain resolves registry credentials; nil uses the default keychain
+	Keychain authn.Keychain
+	// QuayHosts are registries besides quay.io whose tag API reports expiry
+	QuayHosts []string
+}
+
+// keychain returns the keychain registry credentials are resolved with
+func (o Options) keychain() authn.Keychain {
+	if o.Keychain == nil {
+		return authn.DefaultKeychain
+	}
+	return o.Keychain
 }
 
 func main() {
+	opts, args, err := parseGlobalArgs(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitCode(ErrInvalidArguments))
+	}
+	os.Args = append(os.Args[:1], args...)
+
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: ./label-mod <command>")
 		fmt.Println("Commands:")
 		fmt.Println("  remove-labels <image> <label1> [label2] ... [--tag <new-tag>] [--tag <another-tag>] ...")
 		fmt.Println("  update-labels <image> <key=value> [key=value] ... [--tag <new-tag>] [--tag <another-tag>] ...")
 		fmt.Println("  modify-labels <image> [--remove <label1>] [--remove <label2>] [--update <key=value>] [--update <key=value>] [--tag <new-tag>] [--tag <another-tag>] ...")
+		fmt.Println("  migrate-labels <image> [--keep-old] [--tag <new-tag>]")
+		fmt.Println("  undo [operation-id]")
+		fmt.Println("  plan <planfile> <remove-labels|update-labels|modify-labels|migrate-labels> <image> ...")
+		fmt.Println("  apply <planfile>")
+		fmt.Println("  reconcile <file> [--check]")
+		fmt.Println("  batch <file>")
+		fmt.Println("  serve [--listen <addr>] [--max-concurrent <n>]")
+		fmt.Println("  watch-webhooks <rules-file> [--listen <addr>]")
+		fmt.Println("  keepalive <config> [--once]")
+		fmt.Println("  expiry-report <repository>")
+		fmt.Println("  ls <repository> [--labels <key,key>] [--concurrency <n>]")
+		fmt.Println("  find <repository> --label <key=value|key~regex> [--label ...] [--concurrency <n>]")
+		fmt.Println("  inventory <repository> [repository] ... | --catalog <registry> [--format csv|jsonl] [--concurrency <n>]")
+		fmt.Println("  cache prune [--older-than <duration>]")
 		fmt.Println("  test <image>")
+		fmt.Println("  lint <image> [--rules oci,label-schema,redhat]")
+		fmt.Println("  schema")
+		fmt.Println("Global options:")
+		fmt.Println("  --retries <n>                  Retry transient registry failures up to n times (default 3)")
+		fmt.Println("  --retry-backoff <duration>     Initial wait between retries, doubled each attempt (default 1s)")
+		fmt.Println("  --retry-max-backoff <duration> Upper bound on the wait between retries, including Retry-After (default 30s)")
+		fmt.Println("  --output <format>              json, jsonl, yaml, table, sarif or template=<go-template> (default json)")
+		fmt.Println("  --results-dir <dir>            Write IMAGE_DIGEST, IMAGE_URL and TAGGED_AS Tekton results to dir")
+		fmt.Println("  --github-output                Append image_digest, image_url and tagged_as to $GITHUB_OUTPUT")
+		fmt.Println("  --copy-referrers               Re-attach attestations, SBOMs and OCI referrers to the new digest")
+		fmt.Println("  --sign-key <path>              Sign the new digest with an unencrypted ECDSA or Ed25519 PEM key")
+		fmt.Println("  --provenance                   Attach an in-toto statement recording the label change to the new digest")
+		fmt.Println("  --policy <file>                Refuse changes that break the label policy in a YAML or JSON file")
+		fmt.Println("  --journal <file>               Record mutations for undo in file (default ~/.local/state/label-mod/journal.jsonl)")
+		fmt.Println("  --no-journal                   Do not record mutations")
+		fmt.Println("  --cache-dir <dir>              Cache manifests and configs by digest in dir (default ~/.cache/label-mod)")
+		fmt.Println("  --no-cache                     Fetch everything from the registry")
+		fmt.Println("  --strict-no-blobs              Fail instead of downloading or uploading any layer")
+		fmt.Println("  --raw-config                   Change only the labels in the config, keeping every other byte")
+		fmt.Println("  --quay-host <host>             Treat host as Quay and read tag expiry from its API (quay.io always is)")
 		fmt.Println("Example:")
 		fmt.Println("  ./label-mod remove-labels quay.io/bcook/labeltest/test:latest quay.expires-after")
 		fmt.Println("  ./label-mod remove-labels quay.io/bcook/labeltest/test:latest quay.expires-after --tag no-expiry --tag latest")
 		fmt.Println("  ./label-mod update-labels quay.io/bcook/labeltest/test:latest quay.expires-after=2024-12-31 --tag updated --tag v1.0")
 		fmt.Println("  ./label-mod modify-labels quay.io/bcook/labeltest/test:latest --remove quay.expires-after --update test.label=new-value --tag modified --tag stable")
-		os.Exit(1)
+		os.Exit(exitCode(ErrInvalidArguments))
 	}
 
 	command := os.Args[1]
@@ -58,84 +211,337 @@ func main() {
 	case "remove-labels":
 		if len(os.Args) < 4 {
 			fmt.Println("Usage: ./label-mod remove-labels <image> <label1> [label2] ... [--tag <new-tag>]")
-			os.Exit(1)
+			os.Exit(exitCode(ErrInvalidArguments))
 		}
 		image := os.Args[2]
 		args := os.Args[3:]
 		labelsToRemove, newTags := parseArgs(args)
-		result := removeLabels(image, labelsToRemove, newTags)
-		outputJSON(result)
+		result := removeLabels(image, labelsToRemove, newTags, opts)
+		outputResult(result, opts)
 
 	case "update-labels":
 		if len(os.Args) < 4 {
 			fmt.Println("Usage: ./label-mod update-labels <image> <key=value> [key=value] ... [--tag <new-tag>]")
-			os.Exit(1)
+			os.Exit(exitCode(ErrInvalidArguments))
 		}
 		image := os.Args[2]
 		args := os.Args[3:]
 		labelUpdates, newTags := parseUpdateArgs(args)
-		result := updateLabels(image, labelUpdates, newTags)
-		outputJSON(result)
+		result := updateLabels(image, labelUpdates, newTags, opts)
+		outputResult(result, opts)
 
 	case "modify-labels":
 		if len(os.Args) < 3 {
 			fmt.Println("Usage: ./label-mod modify-labels <image> [--remove <label1>] [--remove <label2>] [--update <key=value>] [--update <key=value>] [--tag <new-tag>]")
-			os.Exit(1)
+			os.Exit(exitCode(ErrInvalidArguments))
 		}
 		image := os.Args[2]
 		args := os.Args[3:]
 		labelsToRemove, labelUpdates, newTags := parseModifyArgs(args)
-		result := modifyLabels(image, labelsToRemove, labelUpdates, newTags)
-		outputJSON(result)
+		result := modifyLabels(image, labelsToRemove, labelUpdates, newTags, opts)
+		outputResult(result, opts)
+
+	case "migrate-labels":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: ./label-mod migrate-labels <image> [--keep-old] [--tag <new-tag>]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		image := os.Args[2]
+		keepOld, newTags := parseMigrateArgs(os.Args[3:])
+		result := migrateLabels(image, keepOld, newTags, opts)
+		outputResult(result, opts)
+
+	case "undo":
+		id := ""
+		if len(os.Args) > 2 {
+			id = os.Args[2]
+		}
+		result := undoOperation(id, opts)
+		outputResult(result, opts)
+
+	case "plan":
+		if len(os.Args) < 5 {
+			fmt.Println("Usage: ./label-mod plan <planfile> <remove-labels|update-labels|modify-labels|migrate-labels> <image> ...")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		item, err := newPlanItem(os.Args[3], os.Args[4], os.Args[5:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		// Nothing is pushed, so no CI step outputs are written
+		result := planChange(os.Args[2], item, opts)
+		outputResults([]Result{result}, opts)
+
+	case "apply":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: ./label-mod apply <planfile>")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		results := applyPlan(os.Args[2], opts)
+		outputResults(results, opts)
+
+	case "reconcile":
+		file, check := parseReconcileArgs(os.Args[2:])
+		if file == "" {
+			fmt.Println("Usage: ./label-mod reconcile <file> [--check]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		results := reconcile(file, check, opts)
+		outputResults(results, opts)
+
+	case "batch":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: ./label-mod batch <file>")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		batch, err := loadBatch(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		results := runBatch(batch, opts)
+		outputResults(results, opts)
+
+	case "serve":
+		addr, maxConcurrent, err := parseServeArgs(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		if err := serve(addr, maxConcurrent, opts); err != nil {
+			fmt.Printf("Error serving: %v\n", err)
+			os.Exit(exitCode(ErrInternal))
+		}
+
+	case "watch-webhooks":
+		configPath, addr := parseWatchArgs(os.Args[2:])
+		if configPath == "" {
+			fmt.Println("Usage: ./label-mod watch-webhooks <rules-file> [--listen <addr>]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		config, err := loadWebhookConfig(configPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		if err := watchWebhooks(addr, config, opts); err != nil {
+			fmt.Printf("Error watching webhooks: %v\n", err)
+			os.Exit(exitCode(errorCode(err)))
+		}
+
+	case "keepalive":
+		configPath, once := parseKeepaliveArgs(os.Args[2:])
+		if configPath == "" {
+			fmt.Println("Usage: ./label-mod keepalive <config> [--once]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		config, err := loadKeepaliveConfig(configPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		if err := runKeepalive(config, once, os.Stdout, opts); err != nil {
+			fmt.Printf("Error running keepalive: %v\n", err)
+			os.Exit(exitCode(ErrInternal))
+		}
+
+	case "expiry-report":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: ./label-mod expiry-report <repository>")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		results := expiryReport(os.Args[2], time.Now(), opts)
+		outputResults(results, opts)
+
+	case "ls":
+		query, err := parseListArgs(os.Args[2:])
+		if err != nil || query.Repository == "" || len(query.Matchers) > 0 {
+			if err != nil {
+				fmt.Println(err)
+			}
+			fmt.Println("Usage: ./label-mod ls <repository> [--labels <key,key>] [--concurrency <n>]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		results := listTags(query, opts)
+		outputResults(results, opts)
+
+	case "find":
+		query, err := parseListArgs(os.Args[2:])
+		if err != nil || query.Repository == "" || len(query.Matchers) == 0 || len(query.Labels) > 0 {
+			if err != nil {
+				fmt.Println(err)
+			}
+			fmt.Println("Usage: ./label-mod find <repository> --label <key=value|key~regex> [--label ...] [--concurrency <n>]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		results := findTags(query, opts)
+		outputResults(results, opts)
+
+	case "inventory":
+		query, err := parseInventoryArgs(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Usage: ./label-mod inventory <repository> [repository] ... | --catalog <registry> [--format csv|jsonl] [--concurrency <n>]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		rows, failures := inventory(query, opts)
+		if err := writeInventory(os.Stdout, rows, query.Format); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing inventory: %v\n", err)
+			os.Exit(exitCode(ErrInternal))
+		}
+		// Failures go to stderr so they cannot corrupt the export
+		for _, failure := range failures {
+			writeResult(os.Stderr, failure, opts.Output)
+		}
+		if len(failures) > 0 {
+			os.Exit(exitCode(failures[0].ErrorCode))
+		}
+
+	case "cache":
+		olderThan, err := parseCacheArgs(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Usage: ./label-mod cache prune [--older-than <duration>]")
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		if err := pruneCache(opts.CacheDir, olderThan); err != nil {
+			fmt.Println(err)
+			os.Exit(exitCode(ErrInternal))
+		}
 
 	case "test":
 		if len(os.Args) < 3 {
 			fmt.Println("Usage: ./label-mod test <image>")
-			os.Exit(1)
+			os.Exit(exitCode(ErrInvalidArguments))
+		}
+		image := os.Args[2]
+		result := testImage(image, opts)
+		outputResult(result, opts)
+
+	case "lint":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: ./label-mod lint <image> [--rules oci,label-schema,redhat]")
+			os.Exit(exitCode(ErrInvalidArguments))
 		}
 		image := os.Args[2]
-		result := testImage(image)
-		outputJSON(result)
+		ruleSets := parseLintArgs(os.Args[3:])
+		result := lintImage(image, ruleSets, opts)
+		outputResult(result, opts)
+
+	case "schema":
+		schema, err := resultSchemaJSON()
+		if err != nil {
+			fmt.Printf("Error generating schema: %v\n", err)
+			os.Exit(exitCode(ErrInternal))
+		}
+		fmt.Println(string(schema))
 
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
-		os.Exit(1)
-	}
-}
-
-func outputJSON(result Result) {
-	jsonData, err := json.MarshalIndent(result, "", "  ")
-	if err != nil {
-		fmt.Printf("Error marshaling JSON: %v\n", err)
-		os.Exit(1)
-	}
-	fmt.Println(string(jsonData))
-
-	if !result.Success {
-		os.Exit(1)
+		os.Exit(exitCode(ErrInvalidArguments))
 	}
 }
 
 // tagImage handles tagging an image (always allowed)
-func tagImage(ref name.Reference, newImg v1.Image, auth authn.Authenticator) error {
-	return remote.Write(ref, newImg, remote.WithAuth(auth))
+func tagImage(ref name.Reference, newImg v1.Image, remoteOpts ...remote.Option) error {
+	return remote.Write(ref, newImg, remoteOpts...)
 }
 
 // pushImageWithDigestHandling handles pushing an image with proper digest reference handling
-func pushImageWithDigestHandling(ref name.Reference, newImg v1.Image, auth authn.Authenticator, newTags []string) error {
+func pushImageWithDigestHandling(ref name.Reference, newImg v1.Image, newTags []string, remoteOpts ...remote.Option) error {
 	// Check if this is a digest reference
 	if _, ok := ref.(name.Digest); ok {
 		// For digest references, we can't push back to the same digest
 		// We need to either tag it or create a new digest reference
 		if len(newTags) == 0 {
-			return fmt.Errorf("cannot push to digest reference without specifying a tag - use --tag to specify a new tag")
+			return newError(ErrDigestRefNeedsTag, "cannot push to digest reference without specifying a tag - use --tag to specify a new tag")
 		}
 		// Don't push to the original digest reference, only tag
 		return nil
 	}
 
 	// Push the updated image to the original reference
-	return remote.Write(ref, newImg, remote.WithAuth(auth))
+	return remote.Write(ref, newImg, remoteOpts...)
+}
+
+// parseGlobalArgs extracts the global options from args, wherever they appear,
+// and returns the remaining command arguments
+func parseGlobalArgs(args []string) (Options, []string, error) {
+	opts := Options{Retry: defaultRetryPolicy(), Output: OutputFormat{Kind: OutputJSON}, Journal: defaultJournalPath(), CacheDir: defaultCacheDir()}
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--github-output":
+			opts.GitHubOutput = true
+		case "--copy-referrers":
+			opts.CopyReferrers = true
+		case "--provenance":
+			opts.Provenance = true
+		case "--no-journal":
+			opts.Journal = ""
+		case "--no-cache":
+			opts.CacheDir = ""
+		case "--strict-no-blobs":
+			opts.StrictNoBlobs = true
+		case "--raw-config":
+			opts.RawConfig = true
+		case "--retries", "--retry-backoff", "--retry-max-backoff", "--output", "--results-dir", "--sign-key", "--policy", "--journal", "--cache-dir", "--quay-host":
+			if i+1 >= len(args) {
+				return opts, nil, fmt.Errorf("Missing value for %s", args[i])
+			}
+			flag, value := args[i], args[i+1]
+			i++ // skip the option value
+
+			switch flag {
+			case "--retries":
+				retries, err := strconv.Atoi(value)
+				if err != nil || retries < 0 {
+					return opts, nil, fmt.Errorf("Invalid value for --retries: %s", value)
+				}
+				opts.Retry.MaxAttempts = retries + 1
+			case "--retry-backoff":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return opts, nil, fmt.Errorf("Invalid value for --retry-backoff: %s", value)
+				}
+				opts.Retry.InitialBackoff = d
+			case "--retry-max-backoff":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return opts, nil, fmt.Errorf("Invalid value for --retry-max-backoff: %s", value)
+				}
+				opts.Retry.MaxBackoff = d
+			case "--output":
+				format, err := parseOutputFormat(value)
+				if err != nil {
+					return opts, nil, err
+				}
+				opts.Output = format
+			case "--results-dir":
+				opts.ResultsDir = value
+			case "--sign-key":
+				opts.SignKey = value
+			case "--policy":
+				opts.PolicyFile = value
+			case "--journal":
+				opts.Journal = value
+			case "--cache-dir":
+				opts.CacheDir = value
+			case "--quay-host":
+				registry, err := name.NewRegistry(value)
+				if err != nil {
+					return opts, nil, fmt.Errorf("Invalid value for --quay-host: %s", value)
+				}
+				opts.QuayHosts = append(opts.QuayHosts, registry.RegistryStr())
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+
+	return opts, rest, nil
 }
 
 func parseArgs(args []string) ([]string, []string) {
@@ -200,158 +606,177 @@ func parseModifyArgs(args []string) ([]string, map[string]string, []string) {
 	return labelsToRemove, labelUpdates, newTags
 }
 
-func removeLabels(imageRef string, labelsToRemove []string, newTags []string) Result {
+// labelEdit applies a label change to labels, recording what it changed in result
+type labelEdit func(labels map[string]string, result *Result) error
+
+func removeLabels(imageRef string, labelsToRemove []string, newTags []string, opts Options) Result {
 	result := Result{
 		ImageRef: imageRef,
 		Removed:  []string{},
 	}
 
-	// Parse image reference
-	ref, err := name.ParseReference(imageRef)
-	if err != nil {
-		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
-		return result
-	}
+	return mutateLabels(result, newTags, opts, func(labels map[string]string, result *Result) error {
+		// Remove labels
+		for _, label := range labelsToRemove {
+			if _, exists := labels[label]; exists {
+				delete(labels, label)
+				result.Removed = append(result.Removed, label)
+			}
+		}
 
-	// Get authentication using go-containerregistry
-	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
-		return result
-	}
+		if len(result.Removed) == 0 {
+			return newError(ErrNothingToChange, "No labels were removed")
+		}
+		return nil
+	})
+}
 
-	// Get image using go-containerregistry
-	img, err := remote.Image(ref, remote.WithAuth(auth))
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting image: %v", err)
-		return result
+func updateLabels(imageRef string, labelUpdates map[string]string, newTags []string, opts Options) Result {
+	result := Result{
+		ImageRef: imageRef,
+		Updated:  make(map[string]string),
 	}
 
-	// Get old digest
-	oldDigest, err := img.Digest()
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting old digest: %v", err)
-		return result
-	}
-	result.OldDigest = oldDigest.String()
+	return mutateLabels(result, newTags, opts, func(labels map[string]string, result *Result) error {
+		// Update labels
+		for key, value := range labelUpdates {
+			labels[key] = value
+			result.Updated[key] = value
+		}
+		return nil
+	})
+}
 
-	// Get config using go-containerregistry
-	config, err := img.ConfigFile()
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting config: %v", err)
-		return result
+func modifyLabels(imageRef string, labelsToRemove []string, labelUpdates map[string]string, newTags []string, opts Options) Result {
+	result := Result{
+		ImageRef: imageRef,
+		Removed:  []string{},
+		Updated:  make(map[string]string),
 	}
 
-	// Check if this is a digest reference before attempting to modify
-	if _, ok := ref.(name.Digest); ok {
-		// For digest references, we can't push back to the same digest
-		// We need to either tag it or create a new digest reference
-		if len(newTags) == 0 {
-			result.Error = "Cannot push to digest reference without specifying a tag. Use --tag to specify a new tag."
-			return result
+	return mutateLabels(result, newTags, opts, func(labels map[string]string, result *Result) error {
+		// Remove labels
+		for _, label := range labelsToRemove {
+			if _, exists := labels[label]; exists {
+				delete(labels, label)
+				result.Removed = append(result.Removed, label)
+			}
 		}
-	}
 
-	// Remove labels
-	removed := false
-	for _, label := range labelsToRemove {
-		if _, exists := config.Config.Labels[label]; exists {
-			delete(config.Config.Labels, label)
-			result.Removed = append(result.Removed, label)
-			removed = true
+		// Update labels
+		for key, value := range labelUpdates {
+			labels[key] = value
+			result.Updated[key] = value
 		}
-	}
+		return nil
+	})
+}
 
-	if !removed {
-		result.Error = "No labels were removed"
-		return result
-	}
+// mutateLabels fetches result.ImageRef, applies edit to its labels, pushes the
+// new image and tags it with newTags
+func mutateLabels(result Result, newTags []string, opts Options, edit labelEdit) Result {
+	return mutateImage(result, newTags, opts, edit, nil)
+}
 
-	// Create new image with updated config
-	newImg, err := mutate.Config(img, config.Config)
+// mutateImage is mutateLabels that also sets annotations on the image manifest
+func mutateImage(result Result, newTags []string, opts Options, edit labelEdit, annotations map[string]string) Result {
+	// Parse image reference
+	ref, err := name.ParseReference(result.ImageRef)
 	if err != nil {
-		result.Error = fmt.Sprintf("Error updating config: %v", err)
+		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
+		result.ErrorCode = ErrInvalidReference
 		return result
 	}
 
-	// Push the updated image
-	if err := pushImageWithDigestHandling(ref, newImg, auth, newTags); err != nil {
-		result.Error = fmt.Sprintf("Error pushing updated image: %v", err)
-		return result
+	// Check every new tag name before anything is pushed
+	tagRefs := make([]name.Tag, 0, len(newTags))
+	for _, tag := range newTags {
+		newRef, err := name.NewTag(fmt.Sprintf("%s:%s", ref.Context().String(), tag))
+		if err != nil {
+			result.Error = fmt.Sprintf("Error creating new tag reference: %v", err)
+			result.ErrorCode = ErrInvalidReference
+			return result
+		}
+		tagRefs = append(tagRefs, newRef)
 	}
 
-	// Get the digest of the new image
-	digest, err := newImg.Digest()
+	// Get authentication using go-containerregistry
+	auth, err := opts.keychain().Resolve(ref.Context())
 	if err != nil {
-		result.Error = fmt.Sprintf("Error getting digest: %v", err)
+		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		result.ErrorCode = ErrAuthFailed
 		return result
 	}
-	result.NewDigest = digest.String()
-	result.Success = true
 
-	// If new tags were specified, tag the image
-	if len(newTags) > 0 {
-		result.TaggedAs = make([]string, 0, len(newTags))
-		for _, tag := range newTags {
-			newRef, err := name.NewTag(fmt.Sprintf("%s:%s", ref.Context().String(), tag))
-			if err != nil {
-				result.Error = fmt.Sprintf("Error creating new tag reference: %v", err)
-				return result
-			}
-
-			if err := tagImage(newRef, newImg, auth); err != nil {
-				result.Error = fmt.Sprintf("Error tagging image: %v", err)
-				return result
-			}
-
-			result.TaggedAs = append(result.TaggedAs, newRef.String())
+	// Load the policy and signing key before changing anything in the registry
+	var policy *Policy
+	if opts.PolicyFile != "" {
+		policy, err = loadPolicy(opts.PolicyFile)
+		if err != nil {
+			result.Error = fmt.Sprintf("Error loading policy: %v", err)
+			result.ErrorCode = ErrInvalidArguments
+			return result
 		}
 	}
 
-	return result
-}
-
-func updateLabels(imageRef string, labelUpdates map[string]string, newTags []string) Result {
-	result := Result{
-		ImageRef: imageRef,
-		Updated:  make(map[string]string),
+	var signingKey crypto.Signer
+	if opts.SignKey != "" {
+		signingKey, err = loadSigningKey(opts.SignKey)
+		if err != nil {
+			result.Error = fmt.Sprintf("Error loading signing key: %v", err)
+			result.ErrorCode = ErrInvalidArguments
+			return result
+		}
 	}
 
-	// Parse image reference
-	ref, err := name.ParseReference(imageRef)
-	if err != nil {
-		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
-		return result
-	}
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+	remoteOpts := remoteOptions(auth, st)
 
-	// Get authentication using go-containerregistry
-	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
+	// Get image and config using go-containerregistry
+	img, config, err := fetchImage(ref, retry, remoteOpts)
 	if err != nil {
-		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		result.Error = fmt.Sprintf("Error getting image: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
 		return result
 	}
 
-	// Get image using go-containerregistry
-	img, err := remote.Image(ref, remote.WithAuth(auth))
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting image: %v", err)
-		return result
+	if opts.StrictNoBlobs {
+		img = strictImage{img}
 	}
 
 	// Get old digest
 	oldDigest, err := img.Digest()
 	if err != nil {
 		result.Error = fmt.Sprintf("Error getting old digest: %v", err)
+		result.ErrorCode = ErrInternal
 		return result
 	}
 	result.OldDigest = oldDigest.String()
 
-	// Get config using go-containerregistry
-	config, err := img.ConfigFile()
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting config: %v", err)
+	// Refuse to apply a planned change to an image that has moved since
+	if opts.ExpectDigest != "" && result.OldDigest != opts.ExpectDigest {
+		result.Error = fmt.Sprintf("%s has moved from %s to %s since the change was planned", result.ImageRef, opts.ExpectDigest, result.OldDigest)
+		result.ErrorCode = ErrPreconditionFailed
 		return result
 	}
+	for _, tagRef := range tagRefs {
+		expected, ok := opts.ExpectTagDigests[tagRef.TagStr()]
+		if !ok {
+			continue
+		}
+		current, err := currentDigest(tagRef, retry, remoteOpts)
+		if err != nil {
+			result.Error = fmt.Sprintf("Error getting tag %s: %v", tagRef, err)
+			result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+			return result
+		}
+		if current != expected {
+			result.Error = fmt.Sprintf("%s has moved from %s to %s since the change was planned", tagRef, digestOrNothing(expected), digestOrNothing(current))
+			result.ErrorCode = ErrPreconditionFailed
+			return result
+		}
+	}
 
 	// Check if this is a digest reference before attempting to modify
 	if _, ok := ref.(name.Digest); ok {
@@ -359,30 +784,98 @@ func updateLabels(imageRef string, labelUpdates map[string]string, newTags []str
 		// We need to either tag it or create a new digest reference
 		if len(newTags) == 0 {
 			result.Error = "Cannot push to digest reference without specifying a tag. Use --tag to specify a new tag."
+			result.ErrorCode = ErrDigestRefNeedsTag
 			return result
 		}
 	}
 
-	// Update labels
 	if config.Config.Labels == nil {
 		config.Config.Labels = make(map[string]string)
 	}
 
-	for key, value := range labelUpdates {
-		config.Config.Labels[key] = value
-		result.Updated[key] = value
+	before := make(map[string]string, len(config.Config.Labels))
+	for key, value := range config.Config.Labels {
+		before[key] = value
+	}
+
+	err = edit(config.Config.Labels, &result)
+	recordPrevious(&result, before)
+	if err != nil {
+		result.Error = err.Error()
+		result.ErrorCode = errorCode(err)
+		return result
+	}
+
+	// Check the final labels against the policy
+	if policy != nil {
+		result.Violations = policy.evaluate(ref.Context().Name(), before, config.Config.Labels)
+		if len(result.Violations) > 0 {
+			err := policyError(result.Violations)
+			result.Error = err.Error()
+			result.ErrorCode = errorCode(err)
+			return result
+		}
 	}
 
 	// Create new image with updated config
-	newImg, err := mutate.Config(img, config.Config)
+	newImg, err := updateConfig(img, config, annotations, opts, &result)
 	if err != nil {
 		result.Error = fmt.Sprintf("Error updating config: %v", err)
+		result.ErrorCode = ErrInternal
 		return result
 	}
+	if len(annotations) > 0 {
+		result.Annotations = annotations
+	}
+
+	// Stop at the digest the change would produce when only planning it, or
+	// once the manifest is pushed untagged when staging it for a batch
+	if opts.DryRun || opts.Stage {
+		digest, err := newImg.Digest()
+		if err != nil {
+			result.Error = fmt.Sprintf("Error getting digest: %v", err)
+			result.ErrorCode = ErrInternal
+			return result
+		}
+		if opts.Stage {
+			err = retry.do("push", func() error {
+				return remote.Write(ref.Context().Digest(digest.String()), newImg, remoteOpts...)
+			})
+			if err != nil {
+				result.Error = fmt.Sprintf("Error pushing updated image: %v", err)
+				result.ErrorCode = registryErrorCode(err, ErrPushDenied)
+				return result
+			}
+		}
+		result.NewDigest = digest.String()
+		result.Success = true
+		return result
+	}
+
+	// Look for signatures and attestations that the new digest will orphan
+	var referrers []Referrer
+	err = retry.do("referrers", func() error {
+		var err error
+		referrers, err = findReferrers(ref.Context().Digest(result.OldDigest), remoteOpts)
+		return err
+	})
+	if err != nil {
+		if opts.CopyReferrers {
+			result.Error = fmt.Sprintf("Error listing referrers: %v", err)
+			result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+			return result
+		}
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Could not list signatures and attestations of %s: %v", result.OldDigest, err))
+	}
+	result.Referrers = referrers
 
 	// Push the updated image
-	if err := pushImageWithDigestHandling(ref, newImg, auth, newTags); err != nil {
+	err = retry.do("push", func() error {
+		return pushImageWithDigestHandling(ref, newImg, newTags, remoteOpts...)
+	})
+	if err != nil {
 		result.Error = fmt.Sprintf("Error pushing updated image: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrPushDenied)
 		return result
 	}
 
@@ -390,23 +883,39 @@ func updateLabels(imageRef string, labelUpdates map[string]string, newTags []str
 	digest, err := newImg.Digest()
 	if err != nil {
 		result.Error = fmt.Sprintf("Error getting digest: %v", err)
+		result.ErrorCode = ErrInternal
 		return result
 	}
 	result.NewDigest = digest.String()
 	result.Success = true
 
-	// If new tags were specified, tag the image
-	if len(newTags) > 0 {
-		result.TaggedAs = make([]string, 0, len(newTags))
-		for _, tag := range newTags {
-			newRef, err := name.NewTag(fmt.Sprintf("%s:%s", ref.Context().String(), tag))
-			if err != nil {
-				result.Error = fmt.Sprintf("Error creating new tag reference: %v", err)
-				return result
+	// If new tags were specified, tag the image. Where each tag pointed before
+	// is journaled so undo can restore it, or delete it if it is new.
+	tagsBefore := make(map[string]string, len(tagRefs))
+	if len(tagRefs) > 0 {
+		result.TaggedAs = make([]string, 0, len(tagRefs))
+		for _, newRef := range tagRefs {
+			if source, ok := ref.(name.Tag); opts.Journal != "" && (!ok || source.String() != newRef.String()) {
+				previous, err := currentDigest(newRef, retry, remoteOpts)
+				if err != nil {
+					result.Success = false
+					result.Error = fmt.Sprintf("Error getting tag %s: %v", newRef, err)
+					result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+					recordOperation(&result, ref, tagsBefore, opts)
+					return result
+				}
+				tagsBefore[newRef.String()] = previous
 			}
 
-			if err := tagImage(newRef, newImg, auth); err != nil {
+			err = retry.do("tag", func() error {
+				return tagImage(newRef, newImg, remoteOpts...)
+			})
+			if err != nil {
+				result.Success = false
 				result.Error = fmt.Sprintf("Error tagging image: %v", err)
+				result.ErrorCode = registryErrorCode(err, ErrPushDenied)
+				// Journal the tags moved so far so they can still be undone
+				recordOperation(&result, ref, tagsBefore, opts)
 				return result
 			}
 
@@ -414,125 +923,233 @@ func updateLabels(imageRef string, labelUpdates map[string]string, newTags []str
 		}
 	}
 
-	return result
-}
+	// Journal the moved tags for undo
+	recordOperation(&result, ref, tagsBefore, opts)
 
-func modifyLabels(imageRef string, labelsToRemove []string, labelUpdates map[string]string, newTags []string) Result {
-	result := Result{
-		ImageRef: imageRef,
-		Removed:  []string{},
-		Updated:  make(map[string]string),
+	// Re-attach attestations, SBOMs and other artifacts to the new digest
+	if len(result.Referrers) > 0 {
+		if err := copyReferrers(&result, ref.Context(), newImg, opts, retry, remoteOpts); err != nil {
+			result.Success = false
+			result.Error = fmt.Sprintf("Error copying referrers: %v", err)
+			result.ErrorCode = registryErrorCode(err, ErrPushDenied)
+			return result
+		}
 	}
 
-	// Parse image reference
-	ref, err := name.ParseReference(imageRef)
-	if err != nil {
-		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
-		return result
+	// Sign the new digest
+	if signingKey != nil {
+		var sigRef name.Digest
+		err := retry.do("sign", func() error {
+			var err error
+			sigRef, err = signImage(signingKey, ref.Context(), digest, remoteOpts)
+			return err
+		})
+		if err != nil {
+			result.Success = false
+			result.Error = fmt.Sprintf("Error signing image: %v", err)
+			result.ErrorCode = registryErrorCode(err, ErrPushDenied)
+			return result
+		}
+		result.SignatureTag = cosignTag(ref.Context().Digest(digest.String()), ".sig").String()
+		result.SignatureDigest = sigRef.DigestStr()
 	}
 
-	// Get authentication using go-containerregistry
-	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
-		return result
+	// Record the change as an attestation on the new digest
+	if opts.Provenance {
+		subject, err := imageDescriptor(newImg)
+		if err != nil {
+			result.Success = false
+			result.Error = fmt.Sprintf("Error getting descriptor: %v", err)
+			result.ErrorCode = ErrInternal
+			return result
+		}
+		statement := provenanceStatement(ref.Context(), result, time.Now())
+
+		var provRef name.Digest
+		err = retry.do("provenance", func() error {
+			var err error
+			provRef, err = pushProvenance(ref.Context(), subject, statement, remoteOpts)
+			return err
+		})
+		if err != nil {
+			result.Success = false
+			result.Error = fmt.Sprintf("Error pushing provenance: %v", err)
+			result.ErrorCode = registryErrorCode(err, ErrPushDenied)
+			return result
+		}
+		result.Provenance = provRef.String()
 	}
 
-	// Get image using go-containerregistry
-	img, err := remote.Image(ref, remote.WithAuth(auth))
+	return result
+}
+
+// updateConfig returns img with the labels of config and annotations set on
+// its manifest. With --raw-config only the labels change inside the original
+// config bytes; otherwise the config is re-encoded by mutate.Config and a
+// warning lists the fields it dropped.
+func updateConfig(img v1.Image, config *v1.ConfigFile, annotations map[string]string, opts Options, result *Result) (v1.Image, error) {
+	raw, err := img.RawConfigFile()
 	if err != nil {
-		result.Error = fmt.Sprintf("Error getting image: %v", err)
-		return result
+		return nil, err
 	}
 
-	// Get old digest
-	oldDigest, err := img.Digest()
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting old digest: %v", err)
-		return result
+	if opts.RawConfig {
+		edited, err := setRawLabels(raw, config.Config.Labels)
+		if err != nil {
+			return nil, err
+		}
+		// mutate.Annotations would re-encode the config, so the raw image sets them itself
+		return withRawConfig(img, edited, annotations)
 	}
-	result.OldDigest = oldDigest.String()
 
-	// Get config using go-containerregistry
-	config, err := img.ConfigFile()
+	dropped, err := droppedConfigFields(raw)
 	if err != nil {
-		result.Error = fmt.Sprintf("Error getting config: %v", err)
-		return result
+		return nil, err
+	}
+	if len(dropped) > 0 {
+		result.DroppedFields = dropped
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Config fields not preserved (use --raw-config to keep them): %s", strings.Join(dropped, ", ")))
 	}
+	updated, err := mutate.Config(img, config.Config)
+	if err != nil {
+		return nil, err
+	}
+	if len(annotations) > 0 {
+		updated = mutate.Annotations(updated, annotations).(v1.Image)
+	}
+	return updated, nil
+}
 
-	// Check if this is a digest reference before attempting to modify
-	if _, ok := ref.(name.Digest); ok {
-		// For digest references, we can't push back to the same digest
-		// We need to either tag it or create a new digest reference
-		if len(newTags) == 0 {
-			result.Error = "Cannot push to digest reference without specifying a tag. Use --tag to specify a new tag."
-			return result
+// copyReferrers copies the referrers recorded in result to newImg when
+// --copy-referrers is set, and warns about every referrer left behind
+func copyReferrers(result *Result, repo name.Repository, newImg v1.Image, opts Options, retry *retrier, remoteOpts []remote.Option) error {
+	var subject v1.Descriptor
+	if opts.CopyReferrers {
+		var err error
+		if subject, err = imageDescriptor(newImg); err != nil {
+			return err
 		}
 	}
 
-	// Remove labels
-	for _, label := range labelsToRemove {
-		if _, exists := config.Config.Labels[label]; exists {
-			delete(config.Config.Labels, label)
-			result.Removed = append(result.Removed, label)
+	for i := range result.Referrers {
+		referrer := &result.Referrers[i]
+		if !opts.CopyReferrers || !referrer.copyable() {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s %s still refers to %s", referrer.Kind, referrer.Reference, result.OldDigest))
+			continue
 		}
-	}
 
-	// Update labels
-	if config.Config.Labels == nil {
-		config.Config.Labels = make(map[string]string)
+		err := retry.do("copy-referrers", func() error {
+			copiedTo, err := copyReferrer(*referrer, subject, repo, remoteOpts)
+			referrer.CopiedTo = copiedTo
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if referrer.boundToSubject() {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s copied to %s is still bound to %s; attest %s again for it to verify", referrer.Kind, referrer.CopiedTo, result.OldDigest, result.NewDigest))
+		}
 	}
 
-	for key, value := range labelUpdates {
-		config.Config.Labels[key] = value
-		result.Updated[key] = value
+	return nil
+}
+
+// recordPrevious stores the original value of every removed or updated label that existed before the edit
+func recordPrevious(result *Result, before map[string]string) {
+	for _, key := range changedLabels(*result) {
+		if value, exists := before[key]; exists {
+			if result.Previous == nil {
+				result.Previous = make(map[string]string)
+			}
+			result.Previous[key] = value
+		}
 	}
+}
 
-	// Create new image with updated config
-	newImg, err := mutate.Config(img, config.Config)
+// imageDescriptor returns the descriptor other manifests use to refer to img
+func imageDescriptor(img v1.Image) (v1.Descriptor, error) {
+	mediaType, err := img.MediaType()
 	if err != nil {
-		result.Error = fmt.Sprintf("Error updating config: %v", err)
-		return result
+		return v1.Descriptor{}, err
 	}
-
-	// Push the updated image
-	if err := pushImageWithDigestHandling(ref, newImg, auth, newTags); err != nil {
-		result.Error = fmt.Sprintf("Error pushing updated image: %v", err)
-		return result
+	size, err := img.Size()
+	if err != nil {
+		return v1.Descriptor{}, err
 	}
-
-	// Get the digest of the new image
-	digest, err := newImg.Digest()
+	digest, err := img.Digest()
 	if err != nil {
-		result.Error = fmt.Sprintf("Error getting digest: %v", err)
-		return result
+		return v1.Descriptor{}, err
 	}
-	result.NewDigest = digest.String()
-	result.Success = true
+	return v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}, nil
+}
 
-	// If new tags were specified, tag the image
-	if len(newTags) > 0 {
-		result.TaggedAs = make([]string, 0, len(newTags))
-		for _, tag := range newTags {
-			newRef, err := name.NewTag(fmt.Sprintf("%s:%s", ref.Context().String(), tag))
+// fetchImage retrieves the image manifest and config blob for ref, retrying
+// transient failures. Tags are resolved with a HEAD request first so the
+// manifest is fetched by digest and can come from the content cache. Layers
+// are never read.
+func fetchImage(ref name.Reference, retry *retrier, remoteOpts []remote.Option) (v1.Image, *v1.ConfigFile, error) {
+	var img v1.Image
+	var config *v1.ConfigFile
+	err := retry.do("fetch", func() error {
+		target := ref
+		if _, isTag := ref.(name.Tag); isTag {
+			desc, err := remote.Head(ref, remoteOpts...)
 			if err != nil {
-				result.Error = fmt.Sprintf("Error creating new tag reference: %v", err)
-				return result
+				return err
 			}
+			target = ref.Context().Digest(desc.Digest.String())
+		}
 
-			if err := tagImage(newRef, newImg, auth); err != nil {
-				result.Error = fmt.Sprintf("Error tagging image: %v", err)
-				return result
-			}
+		var err error
+		img, err = remote.Image(target, remoteOpts...)
+		if err != nil {
+			return err
+		}
+		config, err = img.ConfigFile()
+		return err
+	})
+	return img, config, err
+}
 
-			result.TaggedAs = append(result.TaggedAs, newRef.String())
+// currentDigest returns the digest tag points at, or "" when the tag does not exist
+func currentDigest(tag name.Tag, retry *retrier, remoteOpts []remote.Option) (string, error) {
+	var digest string
+	err := retry.do("fetch", func() error {
+		desc, err := remote.Head(tag, remoteOpts...)
+		if err != nil {
+			return err
 		}
+		digest = desc.Digest.String()
+		return nil
+	})
+	if err != nil && isNotFound(err) {
+		return "", nil
 	}
+	return digest, err
+}
 
-	return result
+// digestOrNothing describes digest in messages, where "" means a missing tag
+func digestOrNothing(digest string) string {
+	if digest == "" {
+		return "nothing"
+	}
+	return digest
+}
+
+// remoteOptions returns the go-containerregistry options shared by every registry call.
+// Retries are handled by retrier, so the library's own status code retries are disabled.
+// The user agent lets watch-webhooks recognise pushes label-mod made itself.
+func remoteOptions(auth authn.Authenticator, st *statusTransport) []remote.Option {
+	return []remote.Option{
+		remote.WithAuth(auth),
+		remote.WithTransport(st),
+		remote.WithUserAgent(userAgent),
+		remote.WithRetryStatusCodes(),
+		remote.WithRetryBackoff(remote.Backoff{Steps: 1}),
+	}
 }
 
-func testImage(imageRef string) Result {
+func testImage(imageRef string, opts Options) Result {
 	result := Result{
 		ImageRef: imageRef,
 		Current:  make(map[string]string),
@@ -542,27 +1159,26 @@ func testImage(imageRef string) Result {
 	ref, err := name.ParseReference(imageRef)
 	if err != nil {
 		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
+		result.ErrorCode = ErrInvalidReference
 		return result
 	}
 
 	// Get authentication using go-containerregistry
-	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
+	auth, err := opts.keychain().Resolve(ref.Context())
 	if err != nil {
 		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		result.ErrorCode = ErrAuthFailed
 		return result
 	}
 
-	// Get image using go-containerregistry
-	img, err := remote.Image(ref, remote.WithAuth(auth))
-	if err != nil {
-		result.Error = fmt.Sprintf("Error getting image: %v", err)
-		return result
-	}
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
 
-	// Get config using go-containerregistry
-	config, err := img.ConfigFile()
+	// Get image and config using go-containerregistry
+	img, config, err := fetchImage(ref, retry, remoteOptions(auth, st))
 	if err != nil {
-		result.Error = fmt.Sprintf("Error getting config: %v", err)
+		result.Error = fmt.Sprintf("Error getting image: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
 		return result
 	}
 
@@ -570,10 +1186,24 @@ func testImage(imageRef string) Result {
 	digest, err := img.Digest()
 	if err != nil {
 		result.Error = fmt.Sprintf("Error getting digest: %v", err)
+		result.ErrorCode = ErrInternal
 		return result
 	}
 	result.NewDigest = digest.String()
 	result.Current = config.Config.Labels
+
+	// Report the fields a relabel without --raw-config would drop
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting config: %v", err)
+		result.ErrorCode = ErrInternal
+		return result
+	}
+	if result.DroppedFields, err = droppedConfigFields(raw); err != nil {
+		result.Error = fmt.Sprintf("Error checking config: %v", err)
+		result.ErrorCode = ErrInternal
+		return result
+	}
 	result.Success = true
 
 	return result
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stepDurationBuckets are the upper bounds in seconds of the registry step latency histogram
+var stepDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics collects the counters and histograms exposed on /metrics by the
+// server modes. The CLI records them too; they are simply never exposed.
+var metrics = newMetricsRegistry()
+
+// metricsRegistry holds every metric, written in the Prometheus text format
+type metricsRegistry struct {
+	mu         sync.Mutex
+	operations map[string]float64 // command, outcome
+	responses  map[string]float64 // method, code
+	steps      map[string]*histogram
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		operations: make(map[string]float64),
+		responses:  make(map[string]float64),
+		steps:      make(map[string]*histogram),
+	}
+}
+
+// labelPairs formats label names and values as name="value",...
+func labelPairs(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%s", pairs[i], strconv.Quote(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+// operationOutcome is "success" or the error code of a failed result
+func operationOutcome(result Result) string {
+	if result.Success {
+		return "success"
+	}
+	if result.ErrorCode == "" {
+		return string(ErrInternal)
+	}
+	return string(result.ErrorCode)
+}
+
+// observeOperation counts a finished command by its outcome
+func (m *metricsRegistry) observeOperation(command string, result Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operations[labelPairs("command", command, "outcome", operationOutcome(result))]++
+}
+
+// observeResponse counts a registry response by method and HTTP status.
+// Requests that got no response are counted with code "error".
+func (m *metricsRegistry) observeResponse(method string, status int) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[labelPairs("method", method, "code", code)]++
+}
+
+// observeStep records the latency of one attempt of a pipeline step such as fetch, push or tag
+func (m *metricsRegistry) observeStep(step string, d time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	key := labelPairs("step", step, "outcome", outcome)
+	seconds := d.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.steps[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(stepDurationBuckets))}
+		m.steps[key] = h
+	}
+	for i, bound := range stepDurationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// writeTo writes every metric in the Prometheus text exposition format
+func (m *metricsRegistry) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeCounter(&b, "label_mod_operations_total", "Operations by command and outcome.", m.operations)
+	writeCounter(&b, "label_mod_registry_responses_total", "Registry HTTP responses by method and status code.", m.responses)
+
+	name := "label_mod_step_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Latency of each attempt of a registry step such as fetch, push or tag.\n", name)
+	fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+	for _, labels := range sortedMetricKeys(m.steps) {
+		h := m.steps[labels]
+		for i, bound := range stepDurationBuckets {
+			fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(&b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeCounter(b *strings.Builder, name, help string, values map[string]float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	for _, labels := range sortedMetricKeys(values) {
+		fmt.Fprintf(b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(values[labels], 'g', -1, 64))
+	}
+}
+
+// sortedMetricKeys returns the label sets of a metric in sorted order
+func sortedMetricKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withObservability adds /metrics, /healthz and /readyz to handler. /readyz
+// fails while ready is false, i.e. before listening and during shutdown.
+func withObservability(handler http.Handler, ready *atomic.Bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := metrics.writeTo(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
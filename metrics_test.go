@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scrape returns the current metrics in the text format
+func scrape(t *testing.T) string {
+	t.Helper()
+
+	var b strings.Builder
+	if err := metrics.writeTo(&b); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+	return b.String()
+}
+
+func TestMetricsFormat(t *testing.T) {
+	m := newMetricsRegistry()
+	m.observeOperation("test", Result{Success: true})
+	m.observeOperation("modify-labels", Result{ErrorCode: ErrNotFound})
+	m.observeResponse(http.MethodGet, http.StatusOK)
+	m.observeResponse(http.MethodPut, 0)
+	m.observeStep("push", 300*time.Millisecond, nil)
+	m.observeStep("push", 2*time.Second, errors.New("boom"))
+
+	var b strings.Builder
+	if err := m.writeTo(&b); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE label_mod_operations_total counter\n",
+		`label_mod_operations_total{command="modify-labels",outcome="not-found"} 1` + "\n",
+		`label_mod_operations_total{command="test",outcome="success"} 1` + "\n",
+		`label_mod_registry_responses_total{method="GET",code="200"} 1` + "\n",
+		`label_mod_registry_responses_total{method="PUT",code="error"} 1` + "\n",
+		"# TYPE label_mod_step_duration_seconds histogram\n",
+		`label_mod_step_duration_seconds_bucket{step="push",outcome="success",le="0.25"} 0` + "\n",
+		`label_mod_step_duration_seconds_bucket{step="push",outcome="success",le="0.5"} 1` + "\n",
+		`label_mod_step_duration_seconds_bucket{step="push",outcome="error",le="+Inf"} 1` + "\n",
+		`label_mod_step_duration_seconds_sum{step="push",outcome="error"} 2` + "\n",
+		`label_mod_step_duration_seconds_count{step="push",outcome="success"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsFromPipeline(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/metrics"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	api := newTestServer(t)
+	var result Result
+	request(t, http.MethodGet, api+"/images/"+repo+":latest/labels", "", &result)
+	request(t, http.MethodGet, api+"/images/"+repo+":missing/labels", "", &result)
+
+	out := scrape(t)
+	for _, want := range []string{
+		`label_mod_operations_total{command="test",outcome="success"}`,
+		`label_mod_operations_total{command="test",outcome="not-found"}`,
+		`label_mod_registry_responses_total{method="GET",code="404"}`,
+		`label_mod_step_duration_seconds_count{step="fetch",outcome="success"}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %s in:\n%s", want, out)
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	var ready atomic.Bool
+	server := httptest.NewServer(withObservability(http.NotFoundHandler(), &ready))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get("/healthz"); status != http.StatusOK {
+		t.Errorf("Expected /healthz to be 200, got %d", status)
+	}
+	if status, _ := get("/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to be 503 before ready, got %d", status)
+	}
+	ready.Store(true)
+	if status, _ := get("/readyz"); status != http.StatusOK {
+		t.Errorf("Expected /readyz to be 200 once ready, got %d", status)
+	}
+	if status, body := get("/metrics"); status != http.StatusOK || !strings.Contains(body, "label_mod_operations_total") {
+		t.Errorf("Expected metrics, got %d: %s", status, body)
+	}
+	if status, _ := get("/other"); status != http.StatusNotFound {
+		t.Errorf("Expected other paths to reach the wrapped handler, got %d", status)
+	}
+}
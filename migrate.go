@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+// MigratedLabel is a deprecated label-schema.org label rewritten to its OCI key
+type MigratedLabel struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Value string `json:"value"`
+}
+
+// migrateLabels rewrites the org.label-schema.* labels of imageRef to their OCI
+// replacements in a single push. When an OCI key is already set its value is
+// kept and a warning is reported. The old keys are removed unless keepOld is set;
+// label-schema keys without an OCI equivalent are left alone.
+func migrateLabels(imageRef string, keepOld bool, newTags []string, opts Options) Result {
+	result := Result{
+		ImageRef: imageRef,
+		Removed:  []string{},
+		Updated:  make(map[string]string),
+	}
+
+	return mutateLabels(result, newTags, opts, func(labels map[string]string, result *Result) error {
+		for _, from := range sortedKeys(labelSchemaReplacements) {
+			value, exists := labels[from]
+			if !exists {
+				continue
+			}
+			to := labelSchemaReplacements[from]
+
+			if current, set := labels[to]; set && current != value {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Kept existing %s=%q instead of %s=%q", to, current, from, value))
+			} else if !set {
+				labels[to] = value
+				result.Updated[to] = value
+			}
+			if !keepOld {
+				delete(labels, from)
+				result.Removed = append(result.Removed, from)
+			}
+			result.Migrated = append(result.Migrated, MigratedLabel{From: from, To: to, Value: labels[to]})
+		}
+
+		if len(result.Removed) == 0 && len(result.Updated) == 0 {
+			return newError(ErrNothingToChange, "No label-schema.org labels to migrate")
+		}
+		return nil
+	})
+}
+
+// parseMigrateArgs returns whether --keep-old was given and the new tags
+func parseMigrateArgs(args []string) (bool, []string) {
+	keepOld := false
+	var newTags []string
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--tag" && i+1 < len(args) {
+			newTags = append(newTags, args[i+1])
+			i++ // skip the tag value
+		} else if args[i] == "--keep-old" {
+			keepOld = true
+		}
+	}
+
+	return keepOld, newTags
+}
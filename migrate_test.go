@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrateLabels(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/migrate"
+	pushTestImage(t, repo+":latest", map[string]string{
+		"org.label-schema.vcs-ref":         "abc123",
+		"org.label-schema.version":         "1.0",
+		"org.label-schema.schema-version":  "1.0",
+		"org.opencontainers.image.version": "2.0",
+	})
+
+	result := migrateLabels(repo+":latest", false, nil, Options{})
+	if !result.Success {
+		t.Fatalf("Migration failed: %+v", result)
+	}
+	if len(result.Migrated) != 2 {
+		t.Fatalf("Expected 2 migrated labels, got %+v", result.Migrated)
+	}
+	if m := result.Migrated[0]; m.From != "org.label-schema.vcs-ref" || m.To != "org.opencontainers.image.revision" || m.Value != "abc123" {
+		t.Errorf("Unexpected migration %+v", m)
+	}
+	if m := result.Migrated[1]; m.Value != "2.0" {
+		t.Errorf("Expected the existing OCI value to be kept, got %+v", m)
+	}
+	if len(result.Warnings) != 1 {
+		t.Errorf("Expected a warning for the conflicting version, got %v", result.Warnings)
+	}
+
+	labels := testImage(repo+":latest", Options{}).Current
+	if labels["org.opencontainers.image.revision"] != "abc123" {
+		t.Errorf("Expected revision to be set, got %v", labels)
+	}
+	if _, ok := labels["org.label-schema.vcs-ref"]; ok {
+		t.Errorf("Expected the old key to be removed, got %v", labels)
+	}
+	if _, ok := labels["org.label-schema.schema-version"]; !ok {
+		t.Errorf("Expected keys without an OCI equivalent to be left alone, got %v", labels)
+	}
+
+	result = migrateLabels(repo+":latest", false, nil, Options{})
+	if result.ErrorCode != ErrNothingToChange {
+		t.Errorf("Expected nothing-to-change on a migrated image, got %+v", result)
+	}
+}
+
+func TestMigrateLabelsKeepOld(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/migrate"
+	pushTestImage(t, repo+":latest", map[string]string{"org.label-schema.vcs-url": "https://github.com/org/repo"})
+
+	keepOld, newTags := parseMigrateArgs([]string{"--keep-old", "--tag", "migrated"})
+	result := migrateLabels(repo+":latest", keepOld, newTags, Options{})
+	if !result.Success || len(result.Removed) != 0 {
+		t.Fatalf("Expected the old key to be kept, got %+v", result)
+	}
+
+	labels := testImage(repo+":migrated", Options{}).Current
+	if labels["org.label-schema.vcs-url"] == "" || labels["org.opencontainers.image.source"] != "https://github.com/org/repo" {
+		t.Errorf("Expected both keys on the new tag, got %v", labels)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Output format names accepted by --output
+const (
+	OutputJSON     = "json"
+	OutputJSONL    = "jsonl"
+	OutputYAML     = "yaml"
+	OutputTable    = "table"
+	OutputTemplate = "template"
+	OutputSARIF    = "sarif"
+)
+
+// OutputFormat selects how results are written to stdout
+type OutputFormat struct {
+	Kind     string
+	Template *template.Template
+}
+
+// parseOutputFormat parses the value of --output. Templates are given as
+// template=<text> and are executed against Result using its Go field names.
+func parseOutputFormat(value string) (OutputFormat, error) {
+	if text, ok := strings.CutPrefix(value, OutputTemplate+"="); ok {
+		tmpl, err := template.New("output").Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return OutputFormat{}, fmt.Errorf("Invalid output template: %v", err)
+		}
+		return OutputFormat{Kind: OutputTemplate, Template: tmpl}, nil
+	}
+
+	switch value {
+	case OutputJSON, OutputJSONL, OutputYAML, OutputTable, OutputSARIF:
+		return OutputFormat{Kind: value}, nil
+	}
+	return OutputFormat{}, fmt.Errorf("Invalid value for --output: %s (expected json, jsonl, yaml, table, sarif or template=<tmpl>)", value)
+}
+
+// outputResult writes the CI step outputs and result in the selected format,
+// then exits with the status matching its error code if it failed
+func outputResult(result Result, opts Options) {
+	if err := writeStepOutputs(result, opts); err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		result.ErrorCode = ErrInternal
+	}
+
+	if err := writeResult(os.Stdout, result, opts.Output); err != nil {
+		fmt.Printf("Error writing output: %v\n", err)
+		os.Exit(exitCode(ErrInternal))
+	}
+
+	if !result.Success {
+		os.Exit(exitCode(result.ErrorCode))
+	}
+}
+
+// outputResults writes each result in the selected format, then exits with the
+// status of the first failed result. CI step outputs describe a single image,
+// so they are not written.
+func outputResults(results []Result, opts Options) {
+	var failed *Result
+	for i := range results {
+		if err := writeResult(os.Stdout, results[i], opts.Output); err != nil {
+			fmt.Printf("Error writing output: %v\n", err)
+			os.Exit(exitCode(ErrInternal))
+		}
+		if !results[i].Success && failed == nil {
+			failed = &results[i]
+		}
+	}
+
+	if failed != nil {
+		os.Exit(exitCode(failed.ErrorCode))
+	}
+}
+
+// writeResult writes a single result to w in the given format
+func writeResult(w io.Writer, result Result, format OutputFormat) error {
+	result.SchemaVersion = resultSchemaVersion
+
+	switch format.Kind {
+	case OutputJSONL:
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+
+	case OutputYAML:
+		data, err := yaml.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+
+	case OutputTable:
+		return writeTable(w, result)
+
+	case OutputSARIF:
+		data, err := json.MarshalIndent(sarifLog(result), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+
+	case OutputTemplate:
+		if err := format.Template.Execute(w, result); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+
+	default:
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+}
+
+// writeTable writes a human readable summary of result. Read-only results list
+// the current labels; mutations list each changed label with its value before
+// and after.
+func writeTable(w io.Writer, result Result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "IMAGE\t%s\n", result.ImageRef)
+	if result.OldDigest != "" {
+		fmt.Fprintf(tw, "OLD DIGEST\t%s\n", result.OldDigest)
+	}
+	if result.NewDigest != "" {
+		if result.OldDigest != "" {
+			fmt.Fprintf(tw, "NEW DIGEST\t%s\n", result.NewDigest)
+		} else {
+			fmt.Fprintf(tw, "DIGEST\t%s\n", result.NewDigest)
+		}
+	}
+	for _, tag := range result.TaggedAs {
+		fmt.Fprintf(tw, "TAGGED AS\t%s\n", tag)
+	}
+	if result.Expiry != nil {
+		fmt.Fprintf(tw, "EXPIRES\t%s\n", result.Expiry)
+	}
+	if !result.Success {
+		fmt.Fprintf(tw, "ERROR\t%s: %s\n", result.ErrorCode, result.Error)
+	}
+
+	if len(result.Removed) > 0 || len(result.Updated) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "LABEL\tBEFORE\tAFTER")
+		for _, key := range changedLabels(result) {
+			before, existed := result.Previous[key]
+			if !existed {
+				before = "<none>"
+			}
+			after, updated := result.Updated[key]
+			if !updated {
+				after = "<removed>"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", key, before, after)
+		}
+	} else if len(result.Current) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "LABEL\tVALUE")
+		for _, key := range sortedKeys(result.Current) {
+			fmt.Fprintf(tw, "%s\t%s\n", key, result.Current[key])
+		}
+	}
+
+	return tw.Flush()
+}
+
+// changedLabels returns the removed and updated label keys in sorted order
+func changedLabels(result Result) []string {
+	keys := make([]string, 0, len(result.Removed)+len(result.Updated))
+	keys = append(keys, result.Removed...)
+	for key := range result.Updated {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func sampleMutationResult() Result {
+	return Result{
+		Success:   true,
+		ImageRef:  "quay.io/example/app:latest",
+		OldDigest: "sha256:old",
+		NewDigest: "sha256:new",
+		Removed:   []string{"quay.expires-after"},
+		Updated:   map[string]string{"version": "2.0", "release": "1"},
+		Previous:  map[string]string{"quay.expires-after": "2w", "version": "1.0"},
+		TaggedAs:  []string{"quay.io/example/app:stable"},
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	for _, value := range []string{"json", "jsonl", "yaml", "table", "template={{.ImageRef}}"} {
+		if _, err := parseOutputFormat(value); err != nil {
+			t.Errorf("Expected %q to be accepted: %v", value, err)
+		}
+	}
+
+	for _, value := range []string{"", "xml", "template={{.ImageRef"} {
+		if _, err := parseOutputFormat(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestWriteResultTable(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeResult(&buf, sampleMutationResult(), OutputFormat{Kind: OutputTable}); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"OLD DIGEST  sha256:old",
+		"NEW DIGEST  sha256:new",
+		"TAGGED AS   quay.io/example/app:stable",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected table to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	rows := map[string][]string{
+		"quay.expires-after": {"2w", "<removed>"},
+		"release":            {"<none>", "1"},
+		"version":            {"1.0", "2.0"},
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if expected, ok := rows[fields[0]]; ok {
+			if fields[1] != expected[0] || fields[2] != expected[1] {
+				t.Errorf("Expected %s to go from %s to %s, got %v", fields[0], expected[0], expected[1], fields[1:])
+			}
+			delete(rows, fields[0])
+		}
+	}
+	if len(rows) != 0 {
+		t.Errorf("Missing rows for %v in:\n%s", rows, out)
+	}
+}
+
+func TestWriteResultTableCurrentLabels(t *testing.T) {
+	result := Result{
+		Success:   true,
+		ImageRef:  "quay.io/example/app:latest",
+		NewDigest: "sha256:abc",
+		Current:   map[string]string{"b": "2", "a": "1"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeResult(&buf, result, OutputFormat{Kind: OutputTable}); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "DIGEST  sha256:abc") {
+		t.Errorf("Expected digest row, got:\n%s", out)
+	}
+	if strings.Index(out, "a      1") == -1 || strings.Index(out, "a      1") > strings.Index(out, "b      2") {
+		t.Errorf("Expected labels sorted by key, got:\n%s", out)
+	}
+}
+
+func TestWriteResultTemplate(t *testing.T) {
+	format, err := parseOutputFormat("template={{.NewDigest}} {{index .TaggedAs 0}}")
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeResult(&buf, sampleMutationResult(), format); err != nil {
+		t.Fatalf("Failed to execute template: %v", err)
+	}
+
+	if buf.String() != "sha256:new quay.io/example/app:stable\n" {
+		t.Errorf("Unexpected template output: %q", buf.String())
+	}
+}
+
+func TestWriteResultJSONLAndYAML(t *testing.T) {
+	result := sampleMutationResult()
+
+	var buf bytes.Buffer
+	if err := writeResult(&buf, result, OutputFormat{Kind: OutputJSONL}); err != nil {
+		t.Fatalf("Failed to write jsonl: %v", err)
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("Expected a single line of JSON, got %q", buf.String())
+	}
+	var fromJSON Result
+	if err := json.Unmarshal(buf.Bytes(), &fromJSON); err != nil || fromJSON.NewDigest != result.NewDigest {
+		t.Errorf("Expected jsonl to round-trip, got %+v (%v)", fromJSON, err)
+	}
+
+	buf.Reset()
+	if err := writeResult(&buf, result, OutputFormat{Kind: OutputYAML}); err != nil {
+		t.Fatalf("Failed to write yaml: %v", err)
+	}
+	if !strings.Contains(buf.String(), "new_digest: sha256:new") {
+		t.Errorf("Expected yaml to use JSON field names, got:\n%s", buf.String())
+	}
+	var fromYAML Result
+	if err := yaml.Unmarshal(buf.Bytes(), &fromYAML); err != nil || fromYAML.Previous["version"] != "1.0" {
+		t.Errorf("Expected yaml to round-trip, got %+v (%v)", fromYAML, err)
+	}
+}
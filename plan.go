@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// planVersion is written to every plan file and checked by apply
+const planVersion = 1
+
+// Plan is a reviewable list of label changes written by plan and executed by apply
+type Plan struct {
+	Version int        `json:"version"`
+	Items   []PlanItem `json:"items"`
+}
+
+// PlanItem is one planned label change. ExpectedDigest is the digest the image
+// had when the change was planned and TagDigests the digest of each --tag
+// target, empty for a tag that did not exist; apply refuses the item if any of
+// them has moved.
+type PlanItem struct {
+	Command        string            `json:"command"`
+	ImageRef       string            `json:"image_ref"`
+	Remove         []string          `json:"remove,omitempty"`
+	Update         map[string]string `json:"update,omitempty"`
+	KeepOld        bool              `json:"keep_old,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	ExpectedDigest string            `json:"expected_digest"`
+	TagDigests     map[string]string `json:"tag_digests,omitempty"`
+	PlannedDigest  string            `json:"planned_digest"`
+	// Previous holds the values of the changed labels at planning time, for review
+	Previous  map[string]string `json:"previous,omitempty"`
+	PlannedAt time.Time         `json:"planned_at"`
+}
+
+// newPlanItem builds a plan item from the arguments of a mutating command
+func newPlanItem(command, image string, args []string) (PlanItem, error) {
+	item := PlanItem{Command: command, ImageRef: image}
+
+	switch command {
+	case "remove-labels":
+		item.Remove, item.Tags = parseArgs(args)
+	case "update-labels":
+		item.Update, item.Tags = parseUpdateArgs(args)
+	case "modify-labels":
+		item.Remove, item.Update, item.Tags = parseModifyArgs(args)
+	case "migrate-labels":
+		item.KeepOld, item.Tags = parseMigrateArgs(args)
+	default:
+		return item, fmt.Errorf("Cannot plan %s (expected remove-labels, update-labels, modify-labels or migrate-labels)", command)
+	}
+
+	return item, nil
+}
+
+// run executes the change described by item with opts
+func (item PlanItem) run(opts Options) Result {
+	switch item.Command {
+	case "remove-labels":
+		return removeLabels(item.ImageRef, item.Remove, item.Tags, opts)
+	case "update-labels":
+		return updateLabels(item.ImageRef, item.Update, item.Tags, opts)
+	case "modify-labels":
+		return modifyLabels(item.ImageRef, item.Remove, item.Update, item.Tags, opts)
+	case "migrate-labels":
+		return migrateLabels(item.ImageRef, item.KeepOld, item.Tags, opts)
+	}
+	return Result{
+		ImageRef:  item.ImageRef,
+		Error:     fmt.Sprintf("Unknown command in plan: %s", item.Command),
+		ErrorCode: ErrInvalidArguments,
+	}
+}
+
+// readPlan reads a plan file. A missing file is an empty plan so plan can
+// create it.
+func readPlan(path string) (Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Plan{Version: planVersion}, nil
+		}
+		return Plan{}, err
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return Plan{}, fmt.Errorf("Error parsing plan %s: %v", path, err)
+	}
+	if plan.Version != planVersion {
+		return Plan{}, fmt.Errorf("Unsupported plan version %d in %s", plan.Version, path)
+	}
+	return plan, nil
+}
+
+// writePlan writes plan to path as indented JSON
+func writePlan(path string, plan Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// planChange computes the change described by item without pushing anything
+// and appends it to the plan file at path, so several plan runs build up one
+// plan. The result carries the current and planned digests.
+func planChange(path string, item PlanItem, opts Options) Result {
+	plan, err := readPlan(path)
+	if err != nil {
+		return Result{ImageRef: item.ImageRef, Error: err.Error(), ErrorCode: ErrInvalidArguments}
+	}
+
+	opts.DryRun = true
+	result := item.run(opts)
+	if !result.Success {
+		return result
+	}
+
+	item.TagDigests, err = planTagDigests(item, opts)
+	if err != nil {
+		result.Success = false
+		result.Error = fmt.Sprintf("Error getting tags: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return result
+	}
+	item.ExpectedDigest = result.OldDigest
+	item.PlannedDigest = result.NewDigest
+	item.Previous = result.Previous
+	item.PlannedAt = time.Now().UTC()
+	plan.Items = append(plan.Items, item)
+
+	if err := writePlan(path, plan); err != nil {
+		result.Success = false
+		result.Error = fmt.Sprintf("Error writing plan: %v", err)
+		result.ErrorCode = ErrInternal
+	}
+	return result
+}
+
+// planTagDigests returns the digest each --tag target of item points at now, or
+// "" for a tag that does not exist yet
+func planTagDigests(item PlanItem, opts Options) (map[string]string, error) {
+	if len(item.Tags) == 0 {
+		return nil, nil
+	}
+	ref, err := name.ParseReference(item.ImageRef)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := opts.keychain().Resolve(ref.Context())
+	if err != nil {
+		return nil, err
+	}
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &Result{}}
+	remoteOpts := remoteOptions(auth, st)
+
+	digests := make(map[string]string, len(item.Tags))
+	for _, tag := range item.Tags {
+		tagRef, err := name.NewTag(fmt.Sprintf("%s:%s", ref.Context().String(), tag))
+		if err != nil {
+			return nil, newError(ErrInvalidReference, "Error creating new tag reference: %v", err)
+		}
+		digests[tag], err = currentDigest(tagRef, retry, remoteOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// applyPlan executes every item of the plan at path. Items whose image has
+// moved since planning are refused with precondition-failed; the others are
+// still applied.
+func applyPlan(path string, opts Options) []Result {
+	plan, err := readPlan(path)
+	if err == nil && len(plan.Items) == 0 {
+		err = fmt.Errorf("%s contains no planned changes", path)
+	}
+	if err != nil {
+		return []Result{{Error: err.Error(), ErrorCode: ErrInvalidArguments}}
+	}
+
+	results := make([]Result, 0, len(plan.Items))
+	for _, item := range plan.Items {
+		itemOpts := opts
+		itemOpts.ExpectDigest = item.ExpectedDigest
+		itemOpts.ExpectTagDigests = item.TagDigests
+		result := item.run(itemOpts)
+		if result.Success && result.NewDigest != item.PlannedDigest {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Pushed %s instead of the planned %s", result.NewDigest, item.PlannedDigest))
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/plan"
+	pushTestImage(t, repo+":a", map[string]string{"quay.expires-after": "1w", "version": "1"})
+	pushTestImage(t, repo+":b", map[string]string{"version": "1"})
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+
+	for _, args := range [][]string{
+		{"remove-labels", repo + ":a", "quay.expires-after", "--tag", "released"},
+		{"update-labels", repo + ":b", "version=2"},
+	} {
+		item, err := newPlanItem(args[0], args[1], args[2:])
+		if err != nil {
+			t.Fatalf("Failed to build plan item: %v", err)
+		}
+		if result := planChange(planFile, item, Options{}); !result.Success {
+			t.Fatalf("Plan failed: %+v", result)
+		}
+	}
+
+	plan, err := readPlan(planFile)
+	if err != nil {
+		t.Fatalf("Failed to read plan: %v", err)
+	}
+	if len(plan.Items) != 2 {
+		t.Fatalf("Expected 2 planned items, got %+v", plan.Items)
+	}
+	first := plan.Items[0]
+	if first.ExpectedDigest != tagDigest(t, repo+":a") || first.PlannedDigest == first.ExpectedDigest {
+		t.Errorf("Unexpected digests in %+v", first)
+	}
+	if digest, ok := first.TagDigests["released"]; !ok || digest != "" {
+		t.Errorf("Expected the missing --tag target to be recorded, got %v", first.TagDigests)
+	}
+	if first.Previous["quay.expires-after"] != "1w" || len(first.Tags) != 1 {
+		t.Errorf("Expected the change to be recorded for review, got %+v", first)
+	}
+	if tagDigest(t, repo+":a") != first.ExpectedDigest {
+		t.Error("Expected plan not to push anything")
+	}
+
+	// Move b after planning so apply refuses it
+	pushTestImage(t, repo+":b", map[string]string{"version": "1.5"})
+
+	results := applyPlan(planFile, Options{})
+	if len(results) != 2 {
+		t.Fatalf("Expected a result per item, got %+v", results)
+	}
+	if !results[0].Success || results[0].NewDigest != first.PlannedDigest || len(results[0].Warnings) != 0 {
+		t.Errorf("Expected a to be pushed at the planned digest, got %+v", results[0])
+	}
+	if tagDigest(t, repo+":released") != first.PlannedDigest {
+		t.Error("Expected the planned tag to be pushed")
+	}
+	if results[1].Success || results[1].ErrorCode != ErrPreconditionFailed {
+		t.Errorf("Expected b to be refused, got %+v", results[1])
+	}
+}
+
+func TestPlanRejectsUnknownCommands(t *testing.T) {
+	if _, err := newPlanItem("test", "quay.io/org/app:latest", nil); err == nil {
+		t.Error("Expected read-only commands to be rejected")
+	}
+
+	results := applyPlan(filepath.Join(t.TempDir(), "missing.json"), Options{})
+	if len(results) != 1 || results[0].ErrorCode != ErrInvalidArguments {
+		t.Errorf("Expected an empty plan to be rejected, got %+v", results)
+	}
+}
+
+func TestApplyRefusesMovedTagTargets(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/plan"
+	pushTestImage(t, repo+":a", map[string]string{"version": "1"})
+	pushTestImage(t, repo+":stable", map[string]string{"version": "0"})
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+
+	item, err := newPlanItem("update-labels", repo+":a", []string{"version=2", "--tag", "stable", "--tag", "next"})
+	if err != nil {
+		t.Fatalf("Failed to build plan item: %v", err)
+	}
+	if result := planChange(planFile, item, Options{}); !result.Success {
+		t.Fatalf("Plan failed: %+v", result)
+	}
+	plan, err := readPlan(planFile)
+	if err != nil {
+		t.Fatalf("Failed to read plan: %v", err)
+	}
+	stable := tagDigest(t, repo+":stable")
+	if got := plan.Items[0].TagDigests; got["stable"] != stable || got["next"] != "" || len(got) != 2 {
+		t.Errorf("Expected stable at %s and next missing, got %v", stable, got)
+	}
+
+	// Create next after planning; apply must not overwrite it
+	pushTestImage(t, repo+":next", map[string]string{"version": "9"})
+	next := tagDigest(t, repo+":next")
+	before := tagDigest(t, repo+":a")
+
+	results := applyPlan(planFile, Options{})
+	if len(results) != 1 || results[0].Success || results[0].ErrorCode != ErrPreconditionFailed {
+		t.Fatalf("Expected precondition-failed, got %+v", results)
+	}
+	if tagDigest(t, repo+":a") != before || tagDigest(t, repo+":stable") != stable || tagDigest(t, repo+":next") != next {
+		t.Error("Expected nothing to be pushed")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Kinds of policy violation
+const (
+	ViolationRequired  = "required"
+	ViolationForbidden = "forbidden"
+	ViolationProtected = "protected"
+	ViolationValue     = "value"
+)
+
+// Policy declares label rules checked before every push and by lint
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule applies to the repositories matching any of Repositories, or to
+// every repository when none are given. Patterns are globs where * matches
+// within a path segment and ** matches across segments.
+type PolicyRule struct {
+	Name         string            `json:"name,omitempty"`
+	Repositories []string          `json:"repositories,omitempty"`
+	Required     []string          `json:"required,omitempty"`
+	Forbidden    []string          `json:"forbidden,omitempty"`
+	Protected    []string          `json:"protected,omitempty"`
+	Values       map[string]string `json:"values,omitempty"`
+
+	repositories []*regexp.Regexp
+	values       map[string]*regexp.Regexp
+}
+
+// PolicyViolation is a single broken policy rule
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Kind    string `json:"kind"`
+	Label   string `json:"label"`
+	Message string `json:"message"`
+}
+
+// loadPolicy reads a YAML or JSON policy file and compiles its patterns
+func loadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, fmt.Errorf("Error parsing policy %s: %v", path, err)
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		for _, pattern := range rule.Repositories {
+			rule.repositories = append(rule.repositories, globToRegexp(pattern))
+		}
+		rule.values = make(map[string]*regexp.Regexp, len(rule.Values))
+		for label, expr := range rule.Values {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value pattern for %s in %s: %v", label, rule.Name, err)
+			}
+			rule.values[label] = re
+		}
+	}
+
+	return &policy, nil
+}
+
+// globToRegexp converts a repository glob to an anchored regular expression
+func globToRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// matches reports whether the rule applies to repository
+func (r *PolicyRule) matches(repository string) bool {
+	if len(r.repositories) == 0 {
+		return true
+	}
+	for _, re := range r.repositories {
+		if re.MatchString(repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate checks the labels an image will end up with against every rule
+// applying to repository. before holds the labels the image had before the
+// change and is used to enforce protected labels; pass the same map twice for
+// an image that is not being changed.
+func (p *Policy) evaluate(repository string, before, after map[string]string) []PolicyViolation {
+	var violations []PolicyViolation
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(repository) {
+			continue
+		}
+		violate := func(kind, label, format string, args ...interface{}) {
+			violations = append(violations, PolicyViolation{
+				Rule:    rule.Name,
+				Kind:    kind,
+				Label:   label,
+				Message: fmt.Sprintf(format, args...),
+			})
+		}
+
+		for _, label := range rule.Required {
+			if _, ok := after[label]; !ok {
+				violate(ViolationRequired, label, "label %s is required", label)
+			}
+		}
+
+		for _, label := range rule.Forbidden {
+			if _, ok := after[label]; ok {
+				violate(ViolationForbidden, label, "label %s is forbidden", label)
+			}
+		}
+
+		for _, label := range rule.Protected {
+			old, existed := before[label]
+			if !existed {
+				continue
+			}
+			if value, ok := after[label]; !ok {
+				violate(ViolationProtected, label, "label %s is protected and may not be removed", label)
+			} else if value != old {
+				violate(ViolationProtected, label, "label %s is protected and may not be changed from %q to %q", label, old, value)
+			}
+		}
+
+		for _, label := range sortedKeys(rule.Values) {
+			value, ok := after[label]
+			if ok && !rule.values[label].MatchString(value) {
+				violate(ViolationValue, label, "label %s value %q does not match %s", label, value, rule.Values[label])
+			}
+		}
+	}
+
+	return violations
+}
+
+// policyError summarizes violations in a single error message
+func policyError(violations []PolicyViolation) error {
+	messages := make([]string, 0, len(violations))
+	for _, v := range violations {
+		messages = append(messages, fmt.Sprintf("%s: %s", v.Rule, v.Message))
+	}
+	return newError(ErrPolicyViolation, "Policy violation: %s", strings.Join(messages, "; "))
+}
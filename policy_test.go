@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const testPolicy = `
+rules:
+- name: release
+  repositories: ["*/test/**"]
+  required: [version]
+  forbidden: [quay.expires-after]
+  protected: [com.example.build-id]
+  values:
+    version: '^\d+\.\d+\.\d+$'
+- repositories: ["other/*"]
+  required: [owner]
+`
+
+// writePolicy writes a policy file and returns its path
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	return path
+}
+
+func TestLoadPolicy(t *testing.T) {
+	policy, err := loadPolicy(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if len(policy.Rules) != 2 || policy.Rules[1].Name != "rules[1]" {
+		t.Errorf("Expected unnamed rules to be named by index, got %+v", policy.Rules)
+	}
+
+	json := `{"rules": [{"name": "json", "required": ["a"]}]}`
+	if _, err := loadPolicy(writePolicy(t, json)); err != nil {
+		t.Errorf("Expected JSON policies to load, got %v", err)
+	}
+
+	for _, bad := range []string{
+		"rules:\n- requird: [a]\n",
+		"rules:\n- values: {a: '('}\n",
+	} {
+		if _, err := loadPolicy(writePolicy(t, bad)); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		repository string
+		want       bool
+	}{
+		{"quay.io/org/*", "quay.io/org/app", true},
+		{"quay.io/org/*", "quay.io/org/team/app", false},
+		{"quay.io/org/**", "quay.io/org/team/app", true},
+		{"quay.io/*/app", "quay.io/org/app", true},
+		{"quay.io/org/app?", "quay.io/org/app1", true},
+		{"quay.io/org/app", "quay.io/org/apps", false},
+	}
+
+	for _, tt := range tests {
+		if got := globToRegexp(tt.pattern).MatchString(tt.repository); got != tt.want {
+			t.Errorf("%s matching %s: expected %v, got %v", tt.pattern, tt.repository, tt.want, got)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := loadPolicy(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	before := map[string]string{"com.example.build-id": "42", "version": "1.0.0"}
+	after := map[string]string{"com.example.build-id": "43", "version": "latest", "quay.expires-after": "2w"}
+
+	violations := policy.evaluate("quay.io/test/app", before, after)
+	kinds := map[string]bool{}
+	for _, v := range violations {
+		kinds[v.Kind] = true
+	}
+	for _, kind := range []string{ViolationForbidden, ViolationProtected, ViolationValue} {
+		if !kinds[kind] {
+			t.Errorf("Expected a %s violation, got %+v", kind, violations)
+		}
+	}
+	if len(violations) != 3 {
+		t.Errorf("Expected 3 violations, got %+v", violations)
+	}
+
+	delete(after, "com.example.build-id")
+	delete(after, "version")
+	violations = policy.evaluate("quay.io/test/app", before, after)
+	var messages []string
+	for _, v := range violations {
+		messages = append(messages, v.Message)
+	}
+	joined := strings.Join(messages, "\n")
+	if !strings.Contains(joined, "version is required") || !strings.Contains(joined, "may not be removed") {
+		t.Errorf("Expected required and protected violations, got %s", joined)
+	}
+
+	if violations := policy.evaluate("quay.io/prod/app", before, after); len(violations) != 0 {
+		t.Errorf("Expected rules for other repositories to be skipped, got %+v", violations)
+	}
+}
+
+func TestPolicyRefusesPush(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/policy"
+	img := pushTestImage(t, repo+":latest", map[string]string{"version": "1.0.0", "com.example.build-id": "42"})
+	before, _ := img.Digest()
+
+	opts := Options{PolicyFile: writePolicy(t, testPolicy)}
+	result := modifyLabels(repo+":latest", []string{"com.example.build-id"}, map[string]string{"version": "next"}, nil, opts)
+	if result.Success || result.ErrorCode != ErrPolicyViolation {
+		t.Fatalf("Expected policy-violation, got %+v", result)
+	}
+	if len(result.Violations) != 2 {
+		t.Errorf("Expected every broken rule to be reported, got %+v", result.Violations)
+	}
+	if result.NewDigest != "" {
+		t.Errorf("Expected nothing to be pushed, got %s", result.NewDigest)
+	}
+
+	desc, err := remote.Head(mustTag(t, repo+":latest"))
+	if err != nil {
+		t.Fatalf("Failed to read tag: %v", err)
+	}
+	if desc.Digest != before {
+		t.Errorf("Expected the tag to be untouched, got %s", desc.Digest)
+	}
+
+	result = updateLabels(repo+":latest", map[string]string{"version": "1.0.1"}, nil, opts)
+	if !result.Success {
+		t.Fatalf("Expected a compliant change to be pushed, got %+v", result)
+	}
+}
+
+func TestLintImagePolicy(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/lint"
+	pushTestImage(t, repo+":good", map[string]string{"version": "1.0.0"})
+	pushTestImage(t, repo+":bad", map[string]string{"quay.expires-after": "1w"})
+
+	opts := Options{PolicyFile: writePolicy(t, testPolicy)}
+
+	if result := lintImage(repo+":good", nil, opts); !result.Success {
+		t.Errorf("Expected compliant image to pass, got %+v", result)
+	}
+
+	result := lintImage(repo+":bad", nil, opts)
+	if result.Success || result.ErrorCode != ErrPolicyViolation || len(result.Violations) != 2 {
+		t.Errorf("Expected required and forbidden violations, got %+v", result)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/user"
+	"sort"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types of the provenance artifact
+const (
+	inTotoMediaType          types.MediaType = "application/vnd.in-toto+json"
+	emptyConfigMediaType     types.MediaType = "application/vnd.oci.empty.v1+json"
+	inTotoStatementType                      = "https://in-toto.io/Statement/v1"
+	labelChangePredicateType                 = "https://github.com/brianwcook/label-mod/label-change/v1"
+)
+
+// inTotoStatement is an in-toto v1 statement with a label change predicate
+type inTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []inTotoSubject      `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     labelChangePredicate `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// labelChangePredicate records who changed which labels on an image
+type labelChangePredicate struct {
+	ImageRef    string            `json:"imageRef"`
+	OldDigest   string            `json:"oldDigest"`
+	NewDigest   string            `json:"newDigest"`
+	Removed     []string          `json:"removed,omitempty"`
+	Updated     map[string]string `json:"updated,omitempty"`
+	Previous    map[string]string `json:"previous,omitempty"`
+	TaggedAs    []string          `json:"taggedAs,omitempty"`
+	Tool        string            `json:"tool"`
+	ToolVersion string            `json:"toolVersion"`
+	Timestamp   string            `json:"timestamp"`
+	InvokedBy   string            `json:"invokedBy"`
+}
+
+// artifactManifest is an OCI 1.1 image manifest carrying an artifact. v1.Manifest
+// has no artifactType field, so the manifest is built here instead.
+type artifactManifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  types.MediaType   `json:"artifactType"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Subject       *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// invokingUser returns the name of the user running label-mod
+func invokingUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// provenanceStatement builds the in-toto statement describing the change recorded in result
+func provenanceStatement(repo name.Repository, result Result, now time.Time) inTotoStatement {
+	removed := append([]string(nil), result.Removed...)
+	sort.Strings(removed)
+
+	newDigest, _ := v1.NewHash(result.NewDigest)
+	return inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []inTotoSubject{{
+			Name:   repo.Name(),
+			Digest: map[string]string{newDigest.Algorithm: newDigest.Hex},
+		}},
+		PredicateType: labelChangePredicateType,
+		Predicate: labelChangePredicate{
+			ImageRef:    result.ImageRef,
+			OldDigest:   result.OldDigest,
+			NewDigest:   result.NewDigest,
+			Removed:     removed,
+			Updated:     result.Updated,
+			Previous:    result.Previous,
+			TaggedAs:    result.TaggedAs,
+			Tool:        "label-mod",
+			ToolVersion: version,
+			Timestamp:   now.UTC().Format(time.RFC3339),
+			InvokedBy:   invokingUser(),
+		},
+	}
+}
+
+// pushProvenance pushes an artifact holding statement whose subject is the
+// image described by subject, and returns its digest reference
+func pushProvenance(repo name.Repository, subject v1.Descriptor, statement inTotoStatement, remoteOpts []remote.Option) (name.Digest, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	config := static.NewLayer([]byte("{}"), emptyConfigMediaType)
+	layer := static.NewLayer(payload, inTotoMediaType)
+	for _, blob := range []v1.Layer{config, layer} {
+		if err := remote.WriteLayer(repo, blob, remoteOpts...); err != nil {
+			return name.Digest{}, err
+		}
+	}
+
+	configDesc, err := layerDescriptor(config, emptyConfigMediaType)
+	if err != nil {
+		return name.Digest{}, err
+	}
+	layerDesc, err := layerDescriptor(layer, inTotoMediaType)
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	manifest, err := json.Marshal(artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  inTotoMediaType,
+		Config:        configDesc,
+		Layers:        []v1.Descriptor{layerDesc},
+		Subject: &v1.Descriptor{
+			MediaType: subject.MediaType,
+			Size:      subject.Size,
+			Digest:    subject.Digest,
+		},
+		Annotations: map[string]string{
+			"org.opencontainers.image.created": statement.Predicate.Timestamp,
+		},
+	})
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	h, _, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return name.Digest{}, err
+	}
+	target := repo.Digest(h.String())
+	if err := remote.Put(target, rawManifest{data: manifest, mediaType: types.OCIManifestSchema1}, remoteOpts...); err != nil {
+		return name.Digest{}, err
+	}
+	return target, nil
+}
+
+// layerDescriptor returns the descriptor of a blob
+func layerDescriptor(layer v1.Layer, mediaType types.MediaType) (v1.Descriptor, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestProvenanceAttachedToNewDigest(t *testing.T) {
+	for _, referrersAPI := range []bool{true, false} {
+		host := newTestRegistry(t, registry.WithReferrersSupport(referrersAPI))
+		repo := host + "/test/audited"
+		pushTestImage(t, repo+":latest", map[string]string{"quay.expires-after": "2w", "version": "1"})
+
+		opts := Options{Retry: RetryPolicy{MaxAttempts: 1}, Provenance: true}
+		result := modifyLabels(repo+":latest", []string{"quay.expires-after"}, map[string]string{"version": "2"}, []string{"stable"}, opts)
+		if !result.Success || result.Error != "" {
+			t.Fatalf("Modify failed (referrers API %v): %s", referrersAPI, result.Error)
+		}
+		if result.Provenance == "" {
+			t.Fatalf("Expected provenance to be reported")
+		}
+
+		index, err := remote.Referrers(mustDigest(t, repo+"@"+result.NewDigest))
+		if err != nil {
+			t.Fatalf("Failed to list referrers: %v", err)
+		}
+		manifest, _ := index.IndexManifest()
+		if len(manifest.Manifests) != 1 {
+			t.Fatalf("Expected one referrer on the new digest (referrers API %v), got %d", referrersAPI, len(manifest.Manifests))
+		}
+		if got := repo + "@" + manifest.Manifests[0].Digest.String(); got != result.Provenance {
+			t.Errorf("Expected referrer %s, got %s", result.Provenance, got)
+		}
+
+		statement := readStatement(t, result.Provenance)
+		if statement.Type != inTotoStatementType || statement.PredicateType != labelChangePredicateType {
+			t.Errorf("Unexpected statement types %s / %s", statement.Type, statement.PredicateType)
+		}
+		if len(statement.Subject) != 1 || "sha256:"+statement.Subject[0].Digest["sha256"] != result.NewDigest {
+			t.Errorf("Expected subject %s, got %+v", result.NewDigest, statement.Subject)
+		}
+
+		p := statement.Predicate
+		if p.OldDigest != result.OldDigest || p.NewDigest != result.NewDigest {
+			t.Errorf("Expected digests %s -> %s, got %s -> %s", result.OldDigest, result.NewDigest, p.OldDigest, p.NewDigest)
+		}
+		if len(p.Removed) != 1 || p.Removed[0] != "quay.expires-after" || p.Updated["version"] != "2" || p.Previous["version"] != "1" {
+			t.Errorf("Unexpected label changes in predicate: %+v", p)
+		}
+		if p.Tool != "label-mod" || p.ToolVersion == "" || p.Timestamp == "" {
+			t.Errorf("Expected tool, version and timestamp, got %+v", p)
+		}
+		if len(p.TaggedAs) != 1 {
+			t.Errorf("Expected the new tag to be recorded, got %v", p.TaggedAs)
+		}
+	}
+}
+
+// readStatement fetches the in-toto statement stored in the provenance artifact at ref
+func readStatement(t *testing.T, ref string) inTotoStatement {
+	t.Helper()
+
+	digest, err := name.NewDigest(ref)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", ref, err)
+	}
+	desc, err := remote.Get(digest)
+	if err != nil {
+		t.Fatalf("Failed to fetch provenance: %v", err)
+	}
+
+	var manifest artifactManifest
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		t.Fatalf("Failed to parse provenance manifest: %v", err)
+	}
+	if manifest.ArtifactType != inTotoMediaType || len(manifest.Layers) != 1 {
+		t.Fatalf("Unexpected provenance manifest: %s", desc.Manifest)
+	}
+
+	layer, err := remote.Layer(digest.Context().Digest(manifest.Layers[0].Digest.String()))
+	if err != nil {
+		t.Fatalf("Failed to fetch statement: %v", err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatalf("Failed to read statement: %v", err)
+	}
+	defer rc.Close()
+	data, _ := io.ReadAll(rc)
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		t.Fatalf("Failed to parse statement: %v", err)
+	}
+	return statement
+}
+
+func TestProvenanceStatementTimestamp(t *testing.T) {
+	result := Result{ImageRef: "quay.io/example/app:latest", OldDigest: "sha256:1111111111111111111111111111111111111111111111111111111111111111", NewDigest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+	repo, _ := name.NewRepository("quay.io/example/app")
+
+	statement := provenanceStatement(repo, result, time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600)))
+	if statement.Predicate.Timestamp != "2024-05-01T08:00:00Z" {
+		t.Errorf("Expected UTC timestamp, got %s", statement.Predicate.Timestamp)
+	}
+	if statement.Subject[0].Name != "quay.io/example/app" {
+		t.Errorf("Expected subject name quay.io/example/app, got %s", statement.Subject[0].Name)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// quayAPITimeout bounds a call to the Quay tag API
+const quayAPITimeout = 30 * time.Second
+
+// quayTagList is the response of the Quay tag API
+type quayTagList struct {
+	Tags []struct {
+		Name string `json:"name"`
+		// EndTS is when Quay garbage collects the tag, in seconds since the epoch
+		EndTS *int64 `json:"end_ts"`
+		// Expiration is EndTS as an RFC 1123 date
+		Expiration string `json:"expiration"`
+	} `json:"tags"`
+}
+
+// quayHost is the public Quay registry; other Quay installations are named
+// with --quay-host
+const quayHost = "quay.io"
+
+// isQuayRegistry reports whether registry is Quay, so its tag API may be
+// called with the registry credentials
+func isQuayRegistry(registry name.Registry, opts Options) bool {
+	host := registry.RegistryStr()
+	if host == quayHost {
+		return true
+	}
+	for _, quay := range opts.QuayHosts {
+		if host == quay {
+			return true
+		}
+	}
+	return false
+}
+
+// quayTagExpiry asks the Quay tag API when tag expires. found is false when
+// the registry is not Quay, the API fails or it does not know the tag; expires
+// is nil when Quay will not expire the tag. The calls are retried and counted
+// in result like registry calls, but a failure is not reported there since
+// the expiry can still be computed from the labels.
+func quayTagExpiry(tag name.Tag, result *Result, opts Options) (expires *time.Time, found bool) {
+	registry := tag.Context().Registry
+	if !isQuayRegistry(registry, opts) {
+		return nil, false
+	}
+	u := url.URL{
+		Scheme:   registry.Scheme(),
+		Host:     registry.RegistryStr(),
+		Path:     fmt.Sprintf("/api/v1/repository/%s/tag/", tag.RepositoryStr()),
+		RawQuery: url.Values{"specificTag": {tag.TagStr()}, "onlyActiveTags": {"true"}}.Encode(),
+	}
+	auth, err := opts.keychain().Resolve(tag.Context())
+	if err != nil {
+		return nil, false
+	}
+
+	st := readTransport(opts)
+	scratch := Result{}
+	retry := &retrier{policy: opts.Retry, transport: st, result: &scratch}
+	client := &http.Client{Transport: st, Timeout: quayAPITimeout}
+	defer func() {
+		for step, n := range scratch.Attempts {
+			if result.Attempts == nil {
+				result.Attempts = make(map[string]int)
+			}
+			result.Attempts[step] += n
+		}
+		result.Transfer = result.Transfer.add(scratch.Transfer)
+	}()
+
+	var list quayTagList
+	err = retry.do("quay-api", func() error {
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		setQuayAuth(req, auth)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := transport.CheckError(resp, http.StatusOK); err != nil {
+			return err
+		}
+		list = quayTagList{}
+		return json.NewDecoder(resp.Body).Decode(&list)
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	for _, t := range list.Tags {
+		if t.Name != tag.TagStr() {
+			continue
+		}
+		switch {
+		case t.EndTS != nil:
+			at := time.Unix(*t.EndTS, 0).UTC()
+			return &at, true
+		case t.Expiration != "":
+			at, err := time.Parse(time.RFC1123Z, t.Expiration)
+			if err != nil {
+				return nil, false
+			}
+			at = at.UTC()
+			return &at, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// setQuayAuth sends the registry credentials to the Quay API: tokens as bearer
+// tokens, usernames and passwords as basic auth
+func setQuayAuth(req *http.Request, auth authn.Authenticator) {
+	config, err := auth.Authorization()
+	if err != nil {
+		return
+	}
+	switch {
+	case config.RegistryToken != "":
+		req.Header.Set("Authorization", "Bearer "+config.RegistryToken)
+	case config.Username != "" || config.Password != "":
+		req.SetBasicAuth(config.Username, config.Password)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+// quayRegistry returns the host of a registry that also serves the Quay tag
+// API, reporting each tag in ends with that end_ts (no expiry for 0), and the
+// number of API calls it received
+func quayRegistry(t *testing.T, ends map[string]int64) (string, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/v1/repository/") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		calls.Add(1)
+		tag := r.URL.Query().Get("specificTag")
+		end, ok := ends[tag]
+		switch {
+		case !ok:
+			fmt.Fprint(w, `{"tags": [], "page": 1, "has_additional": false}`)
+		case end == 0:
+			fmt.Fprintf(w, `{"tags": [{"name": %q, "start_ts": 1}]}`, tag)
+		default:
+			fmt.Fprintf(w, `{"tags": [{"name": %q, "start_ts": 1, "end_ts": %d, "expiration": "ignored"}]}`, tag, end)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), &calls
+}
+
+func TestExpiryReportUsesQuayTagAPI(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	end := now.Add(3 * time.Hour)
+
+	host, calls := quayRegistry(t, map[string]int64{"expiring": end.Unix(), "kept": 0})
+	repo := host + "/test/quay"
+	// Without the tag API these have no usable creation time
+	pushTestImage(t, repo+":expiring", map[string]string{quayExpiresAfterLabel: "1d"})
+	pushTestImage(t, repo+":kept", map[string]string{quayExpiresAfterLabel: "1d"})
+	pushTestImage(t, repo+":unlisted", map[string]string{quayExpiresAfterLabel: "1d"})
+
+	// Other registries are never asked, so credentials stay with the registry API
+	for _, result := range expiryReport(repo, now, Options{}) {
+		if result.Expiry == nil || result.Expiry.Status != ExpiryUnknown {
+			t.Errorf("Expected the labels to be used for a registry not known as Quay, got %+v", result)
+		}
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("Expected no tag API calls to a registry not known as Quay, got %d", got)
+	}
+
+	byTag := make(map[string]*Expiry)
+	for _, result := range expiryReport(repo, now, Options{QuayHosts: []string{host}}) {
+		if !result.Success || result.Expiry == nil {
+			t.Fatalf("Expected an expiry for every tag, got %+v", result)
+		}
+		if result.Attempts["quay-api"] != 1 || result.Transfer == nil || result.Transfer.Requests < 2 {
+			t.Errorf("Expected the tag API call to be counted, got %+v %+v", result.Attempts, result.Transfer)
+		}
+		byTag[result.ImageRef[len(repo)+1:]] = result.Expiry
+	}
+
+	if got := byTag["expiring"]; got.Status != ExpiryActive || !got.ExpiresAt.Equal(end) {
+		t.Errorf("Expected the end_ts from the tag API, got %+v", got)
+	}
+	if got := byTag["kept"]; got.Status != ExpiryNone {
+		t.Errorf("Expected a tag Quay does not expire to report no expiry, got %+v", got)
+	}
+	if got := byTag["unlisted"]; got.Status != ExpiryUnknown {
+		t.Errorf("Expected a tag missing from the tag API to fall back to the labels, got %+v", got)
+	}
+}
+
+func TestQuayTagExpiryParsesExpiration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repository/org/app/tag/" || r.URL.Query().Get("specificTag") != "v1" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"tags": [{"name": "v1", "expiration": "Wed, 12 Jun 2024 00:00:00 -0000"}]}`)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	opts := Options{QuayHosts: []string{host}}
+
+	expires, found := quayTagExpiry(mustTag(t, host+"/org/app:v1"), &Result{}, opts)
+	if !found || expires == nil || !expires.Equal(time.Date(2024, 6, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the expiration date, got %v %v", expires, found)
+	}
+	if _, found := quayTagExpiry(mustTag(t, host+"/other/app:v1"), &Result{}, opts); found {
+		t.Error("Expected registries without the tag API not to be found")
+	}
+}
+
+func TestIsQuayRegistry(t *testing.T) {
+	opts := Options{QuayHosts: []string{"registry.example.com"}}
+	for ref, want := range map[string]bool{
+		"quay.io/org/app":                 true,
+		"registry.example.com/org/app":    true,
+		"docker.io/library/alpine":        false,
+		"ghcr.io/org/app":                 false,
+		"registry.example.com:5000/org/a": false,
+	} {
+		repo, err := name.NewRepository(ref)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", ref, err)
+		}
+		if got := isQuayRegistry(repo.Registry, opts); got != want {
+			t.Errorf("isQuayRegistry(%s) = %v, want %v", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// setRawLabels returns raw with the value of config.Labels replaced by
+// labels. Every byte outside that value is kept as it is, so fields
+// go-containerregistry does not model survive, unlike with mutate.Config.
+// Object keys are matched case-insensitively, the last duplicate winning, the
+// way encoding/json reads them.
+func setRawLabels(raw []byte, labels map[string]string) ([]byte, error) {
+	if !json.Valid(raw) {
+		return nil, fmt.Errorf("config is not valid JSON")
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	value, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	root := skipSpace(raw, 0)
+	if raw[root] != '{' {
+		return nil, fmt.Errorf("config is not a JSON object")
+	}
+
+	start, end, found, err := findMember(raw, root, "config")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return insertMember(raw, root, `"config":{"Labels":`+string(value)+`}`)
+	}
+	if bytes.Equal(raw[start:end], []byte("null")) {
+		return splice(raw, start, end, `{"Labels":`+string(value)+`}`), nil
+	}
+	if raw[start] != '{' {
+		return nil, fmt.Errorf("config.config is not a JSON object")
+	}
+
+	config := start
+	start, end, found, err = findMember(raw, config, "Labels")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return insertMember(raw, config, `"Labels":`+string(value))
+	}
+	return splice(raw, start, end, string(value)), nil
+}
+
+// splice replaces data[start:end] with value
+func splice(data []byte, start, end int, value string) []byte {
+	out := make([]byte, 0, len(data)-(end-start)+len(value))
+	out = append(out, data[:start]...)
+	out = append(out, value...)
+	return append(out, data[end:]...)
+}
+
+// insertMember adds member as the last member of the object starting at obj,
+// directly after the previous member so trailing whitespace is untouched
+func insertMember(data []byte, obj int, member string) ([]byte, error) {
+	end, err := scanValue(data, obj)
+	if err != nil {
+		return nil, err
+	}
+	last := end - 2 // the byte before the closing brace
+	for last > obj && isSpace(data[last]) {
+		last--
+	}
+	if last == obj {
+		return splice(data, obj+1, obj+1, member), nil
+	}
+	return splice(data, last+1, last+1, ","+member), nil
+}
+
+// findMember returns the span of the value of key in the object starting at obj
+func findMember(data []byte, obj int, key string) (start, end int, found bool, err error) {
+	i := skipSpace(data, obj+1)
+	if data[i] == '}' {
+		return 0, 0, false, nil
+	}
+	for {
+		if data[i] != '"' {
+			return 0, 0, false, fmt.Errorf("expected a key at offset %d", i)
+		}
+		keyEnd, err := scanString(data, i)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		var name string
+		if err := json.Unmarshal(data[i:keyEnd], &name); err != nil {
+			return 0, 0, false, err
+		}
+
+		i = skipSpace(data, keyEnd)
+		if data[i] != ':' {
+			return 0, 0, false, fmt.Errorf("expected ':' at offset %d", i)
+		}
+		valueStart := skipSpace(data, i+1)
+		valueEnd, err := scanValue(data, valueStart)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if strings.EqualFold(name, key) {
+			start, end, found = valueStart, valueEnd, true
+		}
+
+		i = skipSpace(data, valueEnd)
+		switch data[i] {
+		case ',':
+			i = skipSpace(data, i+1)
+		case '}':
+			return start, end, found, nil
+		default:
+			return 0, 0, false, fmt.Errorf("expected ',' or '}' at offset %d", i)
+		}
+	}
+}
+
+// scanValue returns the offset just past the JSON value starting at i
+func scanValue(data []byte, i int) (int, error) {
+	switch data[i] {
+	case '"':
+		return scanString(data, i)
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(data); j++ {
+			switch data[j] {
+			case '"':
+				end, err := scanString(data, j)
+				if err != nil {
+					return 0, err
+				}
+				j = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("unterminated value at offset %d", i)
+	default:
+		j := i
+		for j < len(data) && !isSpace(data[j]) && !strings.ContainsRune(",}]", rune(data[j])) {
+			j++
+		}
+		return j, nil
+	}
+}
+
+// scanString returns the offset just past the JSON string starting at i
+func scanString(data []byte, i int) (int, error) {
+	for j := i + 1; j < len(data); j++ {
+		switch data[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at offset %d", i)
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && isSpace(data[i]) {
+		i++
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// rawConfigImage is base with its config replaced by exact bytes. Layers and
+// the media type come from base; the manifest only changes the config
+// descriptor and annotations.
+type rawConfigImage struct {
+	v1.Image
+	config      []byte
+	manifest    *v1.Manifest
+	rawManifest []byte
+}
+
+// withRawConfig returns base with config as its config blob and annotations
+// added to its manifest
+func withRawConfig(base v1.Image, config []byte, annotations map[string]string) (v1.Image, error) {
+	m, err := base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	manifest := m.DeepCopy()
+	if len(annotations) > 0 {
+		if manifest.Annotations == nil {
+			manifest.Annotations = make(map[string]string, len(annotations))
+		}
+		for key, value := range annotations {
+			manifest.Annotations[key] = value
+		}
+	}
+	manifest.Config.Digest, manifest.Config.Size, err = v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &rawConfigImage{Image: base, config: config, manifest: manifest, rawManifest: rawManifest}, nil
+}
+
+func (i *rawConfigImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+func (i *rawConfigImage) ConfigFile() (*v1.ConfigFile, error) {
+	return v1.ParseConfigFile(bytes.NewReader(i.config))
+}
+
+func (i *rawConfigImage) ConfigName() (v1.Hash, error) {
+	return i.manifest.Config.Digest, nil
+}
+
+func (i *rawConfigImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest.DeepCopy(), nil
+}
+
+func (i *rawConfigImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *rawConfigImage) Digest() (v1.Hash, error) {
+	digest, _, err := v1.SHA256(bytes.NewReader(i.rawManifest))
+	return digest, err
+}
+
+func (i *rawConfigImage) Size() (int64, error) {
+	return int64(len(i.rawManifest)), nil
+}
+
+func (i *rawConfigImage) LayerByDigest(digest v1.Hash) (v1.Layer, error) {
+	if digest == i.manifest.Config.Digest {
+		return partial.ConfigLayer(i)
+	}
+	return i.Image.LayerByDigest(digest)
+}
+
+// droppedConfigFields returns the paths of the fields in raw that do not
+// survive a round trip through v1.ConfigFile, which is what mutate.Config
+// writes. Fields holding a zero value such as null, false or {} are ignored,
+// since dropping them does not change the meaning of the config.
+func droppedConfigFields(raw []byte) ([]string, error) {
+	var before interface{}
+	if err := json.Unmarshal(raw, &before); err != nil {
+		return nil, err
+	}
+	config, err := v1.ParseConfigFile(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	out, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var after interface{}
+	if err := json.Unmarshal(out, &after); err != nil {
+		return nil, err
+	}
+
+	var dropped []string
+	compareJSON("", before, after, &dropped)
+	sort.Strings(dropped)
+	return dropped, nil
+}
+
+// compareJSON appends to dropped the path of every non-zero value in before
+// that is missing from after
+func compareJSON(path string, before, after interface{}, dropped *[]string) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		a, _ := after.(map[string]interface{})
+		for key, value := range b {
+			if isZeroJSON(value) {
+				continue
+			}
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			other, ok := a[key]
+			if !ok {
+				*dropped = append(*dropped, child)
+				continue
+			}
+			compareJSON(child, value, other, dropped)
+		}
+	case []interface{}:
+		a, ok := after.([]interface{})
+		if !ok || len(a) != len(b) {
+			return
+		}
+		for i := range b {
+			compareJSON(fmt.Sprintf("%s[%d]", path, i), b[i], a[i], dropped)
+		}
+	}
+}
+
+// isZeroJSON reports whether v is null, false, 0, "", {} or []
+func isZeroJSON(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
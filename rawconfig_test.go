@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestSetRawLabelsKeepsOtherBytes(t *testing.T) {
+	prefix := `{ "architecture":"amd64",  "vendor.field": {"a": [1, "}"]},
+  "config": {"Env": ["PATH=/bin"], "Labels"  :  `
+	suffix := ` ,"StopSignal":"SIGTERM"}, "os":"linux",
+  "rootfs": {"type": "layers", "diff_ids": []}}`
+	raw := []byte(prefix + `{"a": "b", "q": "\"}"}` + suffix)
+
+	edited, err := setRawLabels(raw, map[string]string{"a": "c"})
+	if err != nil {
+		t.Fatalf("Failed to edit labels: %v", err)
+	}
+	if want := prefix + `{"a":"c"}` + suffix; string(edited) != want {
+		t.Errorf("Expected only the labels to change:\n got %s\nwant %s", edited, want)
+	}
+}
+
+func TestSetRawLabelsAddsMissingLabels(t *testing.T) {
+	for raw, want := range map[string]string{
+		`{"config": {"Env": []} }`:     `{"config": {"Env": [],"Labels":{"a":"b"}} }`,
+		`{"config": { }}`:              `{"config": {"Labels":{"a":"b"} }}`,
+		`{"config": null}`:             `{"config": {"Labels":{"a":"b"}}}`,
+		`{"os": "linux"}`:              `{"os": "linux","config":{"Labels":{"a":"b"}}}`,
+		`{"config": {"labels": null}}`: `{"config": {"labels": {"a":"b"}}}`,
+	} {
+		edited, err := setRawLabels([]byte(raw), map[string]string{"a": "b"})
+		if err != nil || string(edited) != want {
+			t.Errorf("setRawLabels(%s) = %s, %v; want %s", raw, edited, err, want)
+		}
+	}
+
+	for _, bad := range []string{`{"config": `, `[]`, `{"config": "x"}`} {
+		if _, err := setRawLabels([]byte(bad), map[string]string{"a": "b"}); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestDroppedConfigFields(t *testing.T) {
+	raw := []byte(`{
+  "architecture": "amd64",
+  "os": "linux",
+  "vendor.field": "x",
+  "config": {"Labels": {"a": "b"}, "ArgsEscaped": false, "X-Extra": {"k": 1}},
+  "history": [{"created_by": "RUN true", "comment": "kept", "vendor": "dropped"}],
+  "rootfs": {"type": "layers", "diff_ids": []}
+}`)
+
+	dropped, err := droppedConfigFields(raw)
+	if err != nil {
+		t.Fatalf("Failed to check config: %v", err)
+	}
+	if want := []string{"config.X-Extra", "history[0].vendor", "vendor.field"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("Expected %v to be dropped, got %v", want, dropped)
+	}
+}
+
+func TestRawConfigPreservesUnknownFields(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/raw"
+
+	base, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	raw, _ := base.RawConfigFile()
+	raw, err = setRawLabels(raw, map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatalf("Failed to set labels: %v", err)
+	}
+	raw = append([]byte(`{"vendor.field":"x",`), raw[1:]...)
+	img, err := withRawConfig(base, raw, nil)
+	if err != nil {
+		t.Fatalf("Failed to build image: %v", err)
+	}
+	if err := remote.Write(mustTag(t, repo+":latest"), img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	tested := testImage(repo+":latest", Options{})
+	if !reflect.DeepEqual(tested.DroppedFields, []string{"vendor.field"}) {
+		t.Errorf("Expected test to report the unknown field, got %v", tested.DroppedFields)
+	}
+
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, Options{RawConfig: true})
+	if !result.Success || len(result.DroppedFields) != 0 {
+		t.Fatalf("Expected a raw update to drop nothing, got %+v", result)
+	}
+	pushed, err := remote.Image(mustTag(t, repo+":latest"))
+	if err != nil {
+		t.Fatalf("Failed to fetch image: %v", err)
+	}
+	got, _ := pushed.RawConfigFile()
+	want, _ := setRawLabels(raw, map[string]string{"a": "c"})
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected only the labels to change:\n got %s\nwant %s", got, want)
+	}
+
+	// Annotations are set on the raw manifest without re-encoding the config
+	annotated := mutateImage(Result{ImageRef: repo + ":latest"}, nil, Options{RawConfig: true}, func(labels map[string]string, result *Result) error {
+		labels["a"] = "e"
+		return nil
+	}, map[string]string{"org.example.note": "kept"})
+	if !annotated.Success || len(annotated.DroppedFields) != 0 {
+		t.Fatalf("Expected a raw update with annotations to drop nothing, got %+v", annotated)
+	}
+	pushed, err = remote.Image(mustTag(t, repo+":latest"))
+	if err != nil {
+		t.Fatalf("Failed to fetch image: %v", err)
+	}
+	got, _ = pushed.RawConfigFile()
+	want, _ = setRawLabels(raw, map[string]string{"a": "e"})
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected annotations to leave the config bytes alone:\n got %s\nwant %s", got, want)
+	}
+	if manifest, _ := pushed.Manifest(); manifest.Annotations["org.example.note"] != "kept" {
+		t.Errorf("Expected the annotation on the manifest, got %v", manifest.Annotations)
+	}
+
+	result = updateLabels(repo+":latest", map[string]string{"a": "d"}, nil, Options{})
+	if !result.Success || !reflect.DeepEqual(result.DroppedFields, []string{"vendor.field"}) || len(result.Warnings) == 0 {
+		t.Errorf("Expected mutate.Config to report the dropped field, got %+v", result)
+	}
+}
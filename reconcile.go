@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/yaml"
+)
+
+// Drift actions reported by reconcile
+const (
+	DriftSet    = "set"
+	DriftRemove = "remove"
+)
+
+// Kinds of metadata reconcile manages
+const (
+	DriftLabel      = "label"
+	DriftAnnotation = "annotation"
+)
+
+// DesiredState is the reconcile file: the labels and annotations each image should have
+type DesiredState struct {
+	Images []DesiredImage `json:"images"`
+}
+
+// DesiredImage selects images either by Ref, or by Repository and a Tags glob
+// (every tag when empty). Entries are applied in file order, so a later entry
+// overrides an earlier one for the same tag.
+type DesiredImage struct {
+	Ref         string            `json:"ref,omitempty"`
+	Repository  string            `json:"repository,omitempty"`
+	Tags        string            `json:"tags,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Remove      []string          `json:"remove,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Drift is a single difference between an image and its desired state
+type Drift struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`
+	Action  string `json:"action"`
+	Current string `json:"current,omitempty"`
+	Desired string `json:"desired,omitempty"`
+}
+
+// desiredTarget is the merged desired state of one resolved image reference
+type desiredTarget struct {
+	ref         string
+	labels      map[string]string
+	remove      map[string]bool
+	annotations map[string]string
+}
+
+func newDesiredTarget(ref string) *desiredTarget {
+	return &desiredTarget{
+		ref:         ref,
+		labels:      make(map[string]string),
+		remove:      make(map[string]bool),
+		annotations: make(map[string]string),
+	}
+}
+
+// merge adds labels to remove and set to the target, overriding earlier entries
+func (target *desiredTarget) merge(remove []string, labels map[string]string) {
+	for _, key := range remove {
+		delete(target.labels, key)
+		target.remove[key] = true
+	}
+	for key, value := range labels {
+		delete(target.remove, key)
+		target.labels[key] = value
+	}
+}
+
+// loadDesiredState reads and validates a reconcile file
+func loadDesiredState(path string) (*DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state DesiredState
+	if err := yaml.UnmarshalStrict(data, &state); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+
+	for i, image := range state.Images {
+		if (image.Ref == "") == (image.Repository == "") {
+			return nil, fmt.Errorf("images[%d] needs exactly one of ref or repository", i)
+		}
+		if image.Ref != "" && image.Tags != "" {
+			return nil, fmt.Errorf("images[%d] sets tags, which only applies to repository", i)
+		}
+	}
+	return &state, nil
+}
+
+// resolveTargets expands every entry of state to image references and merges
+// the desired state of entries selecting the same reference
+func resolveTargets(state *DesiredState, opts Options) ([]*desiredTarget, []Result) {
+	var targets []*desiredTarget
+	byRef := make(map[string]*desiredTarget)
+	var failures []Result
+
+	for _, image := range state.Images {
+		refs := []string{image.Ref}
+		if image.Repository != "" {
+			var result Result
+			refs, result = listMatchingTags(image.Repository, image.Tags, opts)
+			if result.Error != "" {
+				failures = append(failures, result)
+				continue
+			}
+		}
+
+		for _, ref := range refs {
+			target, ok := byRef[ref]
+			if !ok {
+				target = newDesiredTarget(ref)
+				byRef[ref] = target
+				targets = append(targets, target)
+			}
+			target.merge(image.Remove, image.Labels)
+			for key, value := range image.Annotations {
+				target.annotations[key] = value
+			}
+		}
+	}
+
+	return targets, failures
+}
+
+// listMatchingTags lists the tags of repository matching the glob pattern. On
+// failure the returned result describes the error.
+func listMatchingTags(repository, pattern string, opts Options) ([]string, Result) {
+	result := Result{ImageRef: repository}
+
+	repo, err := name.NewRepository(repository)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error parsing repository: %v", err)
+		result.ErrorCode = ErrInvalidReference
+		return nil, result
+	}
+	auth, err := opts.keychain().Resolve(repo)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		result.ErrorCode = ErrAuthFailed
+		return nil, result
+	}
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	var tags []string
+	err = retry.do("list", func() error {
+		var err error
+		tags, err = remote.List(repo, remoteOptions(auth, st)...)
+		return err
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("Error listing tags: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return nil, result
+	}
+
+	var match *regexp.Regexp
+	if pattern != "" {
+		match = globToRegexp(pattern)
+	}
+	var refs []string
+	for _, tag := range tags {
+		if match == nil || match.MatchString(tag) {
+			refs = append(refs, repo.Tag(tag).String())
+		}
+	}
+	return refs, Result{}
+}
+
+// imageInfo is the image metadata inspectImage returns besides the labels
+type imageInfo struct {
+	annotations map[string]string
+	created     time.Time
+}
+
+// inspectImage returns the digest and labels of imageRef in a Result, along
+// with its manifest annotations and creation time
+func inspectImage(imageRef string, opts Options) (Result, imageInfo) {
+	result := Result{ImageRef: imageRef}
+
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		result.Error = fmt.Sprintf("Error parsing image reference: %v", err)
+		result.ErrorCode = ErrInvalidReference
+		return result, imageInfo{}
+	}
+	auth, err := opts.keychain().Resolve(ref.Context())
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting authentication: %v", err)
+		result.ErrorCode = ErrAuthFailed
+		return result, imageInfo{}
+	}
+
+	st := readTransport(opts)
+	retry := &retrier{policy: opts.Retry, transport: st, result: &result}
+
+	img, config, err := fetchImage(ref, retry, remoteOptions(auth, st))
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting image: %v", err)
+		result.ErrorCode = registryErrorCode(err, ErrAuthFailed)
+		return result, imageInfo{}
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting digest: %v", err)
+		result.ErrorCode = ErrInternal
+		return result, imageInfo{}
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		result.Error = fmt.Sprintf("Error getting manifest: %v", err)
+		result.ErrorCode = ErrInternal
+		return result, imageInfo{}
+	}
+
+	result.OldDigest = digest.String()
+	result.Current = config.Config.Labels
+	result.Success = true
+	return result, imageInfo{annotations: manifest.Annotations, created: config.Created.Time}
+}
+
+// drift compares the labels and annotations of an image with target
+func (target *desiredTarget) drift(labels, annotations map[string]string) []Drift {
+	var drift []Drift
+
+	for _, key := range sortedKeys(target.labels) {
+		if current, ok := labels[key]; !ok || current != target.labels[key] {
+			drift = append(drift, Drift{Kind: DriftLabel, Key: key, Action: DriftSet, Current: current, Desired: target.labels[key]})
+		}
+	}
+	removed := make([]string, 0, len(target.remove))
+	for key := range target.remove {
+		removed = append(removed, key)
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		if current, ok := labels[key]; ok {
+			drift = append(drift, Drift{Kind: DriftLabel, Key: key, Action: DriftRemove, Current: current})
+		}
+	}
+	for _, key := range sortedKeys(target.annotations) {
+		if current, ok := annotations[key]; !ok || current != target.annotations[key] {
+			drift = append(drift, Drift{Kind: DriftAnnotation, Key: key, Action: DriftSet, Current: current, Desired: target.annotations[key]})
+		}
+	}
+
+	return drift
+}
+
+// parseReconcileArgs returns the desired state file and whether --check was given
+func parseReconcileArgs(args []string) (string, bool) {
+	file := ""
+	check := false
+
+	for _, arg := range args {
+		if arg == "--check" {
+			check = true
+		} else if file == "" {
+			file = arg
+		}
+	}
+
+	return file, check
+}
+
+// reconcile brings every image in the desired state file at path in line with
+// it, pushing only the images that drifted. With check set nothing is pushed
+// and drifted images are reported as drift-detected failures.
+func reconcile(path string, check bool, opts Options) []Result {
+	state, err := loadDesiredState(path)
+	if err != nil {
+		return []Result{{Error: err.Error(), ErrorCode: ErrInvalidArguments}}
+	}
+
+	targets, results := resolveTargets(state, opts)
+	for _, target := range targets {
+		current, info := inspectImage(target.ref, opts)
+		if !current.Success {
+			results = append(results, current)
+			continue
+		}
+
+		drift := target.drift(current.Current, info.annotations)
+		if len(drift) == 0 {
+			current.NewDigest = current.OldDigest
+			current.OldDigest = ""
+			results = append(results, current)
+			continue
+		}
+
+		if check {
+			current.Success = false
+			current.Drift = drift
+			current.Error = fmt.Sprintf("%s has drifted from the desired state in %d places", target.ref, len(drift))
+			current.ErrorCode = ErrDriftDetected
+			results = append(results, current)
+			continue
+		}
+
+		results = append(results, target.apply(drift, current.OldDigest, opts))
+	}
+
+	return results
+}
+
+// apply pushes the changes listed in drift, refusing if the image has moved
+// from digest since it was inspected
+func (target *desiredTarget) apply(drift []Drift, digest string, opts Options) Result {
+	result := Result{
+		ImageRef: target.ref,
+		Removed:  []string{},
+		Updated:  make(map[string]string),
+		Drift:    drift,
+	}
+
+	annotations := make(map[string]string)
+	for _, d := range drift {
+		if d.Kind == DriftAnnotation {
+			annotations[d.Key] = d.Desired
+		}
+	}
+
+	opts.ExpectDigest = digest
+	return mutateImage(result, nil, opts, func(labels map[string]string, result *Result) error {
+		for _, d := range drift {
+			switch {
+			case d.Kind != DriftLabel:
+			case d.Action == DriftRemove:
+				delete(labels, d.Key)
+				result.Removed = append(result.Removed, d.Key)
+			default:
+				labels[d.Key] = d.Desired
+				result.Updated[d.Key] = d.Desired
+			}
+		}
+		return nil
+	}, annotations)
+}
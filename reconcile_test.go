@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// writeDesiredState writes a reconcile file and returns its path
+func writeDesiredState(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "labels.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write desired state: %v", err)
+	}
+	return path
+}
+
+func TestLoadDesiredStateValidation(t *testing.T) {
+	for _, bad := range []string{
+		"images:\n- labels: {a: b}\n",
+		"images:\n- ref: quay.io/org/app:1\n  repository: quay.io/org/app\n",
+		"images:\n- ref: quay.io/org/app:1\n  tags: 'v*'\n",
+		"images:\n- ref: quay.io/org/app:1\n  lables: {a: b}\n",
+	} {
+		if _, err := loadDesiredState(writeDesiredState(t, bad)); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/reconcile"
+	pushTestImage(t, repo+":release-1", map[string]string{"quay.expires-after": "1w", "team": "a"})
+	pushTestImage(t, repo+":release-2", map[string]string{"team": "b"})
+	pushTestImage(t, repo+":dev", map[string]string{"quay.expires-after": "1w"})
+	inSync := pushTestImage(t, repo+":pinned", map[string]string{"team": "b"})
+
+	path := writeDesiredState(t, `
+images:
+- repository: `+repo+`
+  tags: "release-*"
+  labels:
+    team: b
+  remove: [quay.expires-after]
+  annotations:
+    org.opencontainers.image.vendor: Example
+- ref: `+repo+`:pinned
+  labels:
+    team: b
+`)
+
+	results := reconcile(path, true, Options{})
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 targets, got %+v", results)
+	}
+	drifted := 0
+	for _, result := range results {
+		if !result.Success {
+			drifted++
+			if result.ErrorCode != ErrDriftDetected || len(result.Drift) == 0 {
+				t.Errorf("Expected drift-detected with drift, got %+v", result)
+			}
+		}
+	}
+	if drifted != 2 {
+		t.Errorf("Expected both release tags to drift, got %+v", results)
+	}
+	if got := results[0].Drift; len(got) != 3 || got[0].Key != "team" || got[1].Action != DriftRemove || got[2].Kind != DriftAnnotation {
+		t.Errorf("Unexpected drift for release-1: %+v", got)
+	}
+	if tagDigest(t, repo+":release-1") == "" || results[0].NewDigest != "" {
+		t.Error("Expected --check not to push anything")
+	}
+
+	results = reconcile(path, false, Options{})
+	for _, result := range results {
+		if !result.Success {
+			t.Errorf("Reconcile failed: %+v", result)
+		}
+	}
+
+	labels := testImage(repo+":release-1", Options{}).Current
+	if labels["team"] != "b" || labels["quay.expires-after"] != "" {
+		t.Errorf("Expected release-1 to match the desired labels, got %v", labels)
+	}
+	img, err := remote.Image(mustTag(t, repo+":release-1"))
+	if err != nil {
+		t.Fatalf("Failed to fetch release-1: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if manifest.Annotations["org.opencontainers.image.vendor"] != "Example" {
+		t.Errorf("Expected the annotation to be set, got %v", manifest.Annotations)
+	}
+	if labels := testImage(repo+":dev", Options{}).Current; labels["quay.expires-after"] != "1w" {
+		t.Errorf("Expected tags outside the pattern to be left alone, got %v", labels)
+	}
+	if digest, _ := inSync.Digest(); tagDigest(t, repo+":pinned") != digest.String() {
+		t.Error("Expected images already in sync not to be pushed")
+	}
+
+	for _, result := range reconcile(path, true, Options{}) {
+		if !result.Success {
+			t.Errorf("Expected no drift after reconciling, got %+v", result)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Referrer kinds reported in Result.Referrers
+const (
+	ReferrerSignature   = "signature"
+	ReferrerAttestation = "attestation"
+	ReferrerSBOM        = "sbom"
+	ReferrerArtifact    = "artifact"
+)
+
+// Where a referrer was found
+const (
+	ReferrerSourceTag       = "tag"
+	ReferrerSourceReferrers = "referrers-api"
+)
+
+// cosignTagSuffixes maps the cosign tag schema suffixes to the kind of artifact they hold
+var cosignTagSuffixes = map[string]string{
+	".sig":  ReferrerSignature,
+	".att":  ReferrerAttestation,
+	".sbom": ReferrerSBOM,
+}
+
+// Referrer is a signature, attestation or other artifact attached to the old image digest
+type Referrer struct {
+	Kind         string `json:"kind"`
+	Source       string `json:"source"`
+	Reference    string `json:"reference"`
+	ArtifactType string `json:"artifact_type,omitempty"`
+	// CopiedTo is the reference the artifact was re-attached to with --copy-referrers
+	CopiedTo string `json:"copied_to,omitempty"`
+}
+
+// copyable reports whether a referrer can be re-attached to a new digest.
+// Signatures cover the exact manifest digest they were made for, so a copy
+// would never verify; the image has to be signed again instead.
+func (r Referrer) copyable() bool {
+	return r.Kind != ReferrerSignature
+}
+
+// boundToSubject reports whether a referrer names the image digest inside its
+// signed content. Attestations are signed in-toto statements whose subject
+// is the old digest, so a copy is found on the new digest but does not verify
+// for it.
+func (r Referrer) boundToSubject() bool {
+	return r.Kind == ReferrerAttestation
+}
+
+// cosignTag returns the cosign tag for digest with the given suffix, e.g. sha256-<hex>.sig
+func cosignTag(digest name.Digest, suffix string) name.Tag {
+	return digest.Context().Tag(strings.Replace(digest.DigestStr(), ":", "-", 1) + suffix)
+}
+
+// referrerKind classifies an OCI referrer by its artifact type
+func referrerKind(artifactType string) string {
+	switch {
+	case strings.Contains(artifactType, "in-toto"):
+		return ReferrerAttestation
+	case strings.Contains(artifactType, "sigstore.bundle"), strings.Contains(artifactType, "signature"):
+		return ReferrerSignature
+	case strings.Contains(artifactType, "spdx"), strings.Contains(artifactType, "cyclonedx"), strings.Contains(artifactType, "sbom"):
+		return ReferrerSBOM
+	}
+	return ReferrerArtifact
+}
+
+// findReferrers lists the cosign tags and OCI referrers attached to digest
+func findReferrers(digest name.Digest, remoteOpts []remote.Option) ([]Referrer, error) {
+	var referrers []Referrer
+
+	for _, suffix := range []string{".sig", ".att", ".sbom"} {
+		tag := cosignTag(digest, suffix)
+		if _, err := remote.Head(tag, remoteOpts...); err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		referrers = append(referrers, Referrer{
+			Kind:      cosignTagSuffixes[suffix],
+			Source:    ReferrerSourceTag,
+			Reference: tag.String(),
+		})
+	}
+
+	index, err := remote.Referrers(digest, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		referrers = append(referrers, Referrer{
+			Kind:         referrerKind(desc.ArtifactType),
+			Source:       ReferrerSourceReferrers,
+			Reference:    digest.Context().Digest(desc.Digest.String()).String(),
+			ArtifactType: desc.ArtifactType,
+		})
+	}
+
+	return referrers, nil
+}
+
+// copyReferrer re-attaches referrer to the image described by subject and
+// returns the reference it was copied to. Cosign tags are copied to the tag for
+// the new digest; OCI referrers are pushed again with their subject rewritten,
+// which go-containerregistry mirrors into the fallback tag on registries
+// without the referrers API.
+func copyReferrer(referrer Referrer, subject v1.Descriptor, repo name.Repository, remoteOpts []remote.Option) (string, error) {
+	newDigest := repo.Digest(subject.Digest.String())
+
+	switch referrer.Source {
+	case ReferrerSourceTag:
+		ref, err := name.ParseReference(referrer.Reference)
+		if err != nil {
+			return "", err
+		}
+		desc, err := remote.Get(ref, remoteOpts...)
+		if err != nil {
+			return "", err
+		}
+		suffix := referrer.Reference[strings.LastIndex(referrer.Reference, "."):]
+		target := cosignTag(newDigest, suffix)
+		if err := remote.Put(target, desc, remoteOpts...); err != nil {
+			return "", err
+		}
+		return target.String(), nil
+
+	case ReferrerSourceReferrers:
+		ref, err := name.ParseReference(referrer.Reference)
+		if err != nil {
+			return "", err
+		}
+		desc, err := remote.Get(ref, remoteOpts...)
+		if err != nil {
+			return "", err
+		}
+		manifest, err := withSubject(desc.Manifest, subject)
+		if err != nil {
+			return "", err
+		}
+		h, _, err := v1.SHA256(bytes.NewReader(manifest))
+		if err != nil {
+			return "", err
+		}
+		target := repo.Digest(h.String())
+		if err := remote.Put(target, rawManifest{data: manifest, mediaType: desc.MediaType}, remoteOpts...); err != nil {
+			return "", err
+		}
+		return target.String(), nil
+	}
+
+	return "", fmt.Errorf("unknown referrer source %q", referrer.Source)
+}
+
+// withSubject returns manifest with its subject replaced by subject, leaving every other field untouched
+func withSubject(manifest []byte, subject v1.Descriptor) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(manifest, &fields); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(v1.Descriptor{
+		MediaType: subject.MediaType,
+		Size:      subject.Size,
+		Digest:    subject.Digest,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields["subject"] = raw
+	return json.Marshal(fields)
+}
+
+// rawManifest lets remote.Put push manifest bytes as they are
+type rawManifest struct {
+	data      []byte
+	mediaType types.MediaType
+}
+
+func (m rawManifest) RawManifest() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m rawManifest) MediaType() (types.MediaType, error) {
+	return m.mediaType, nil
+}
+
+// isNotFound reports whether err is a registry 404
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// descriptorOf returns the descriptor of img for use as a subject
+func descriptorOf(t *testing.T, img v1.Image) v1.Descriptor {
+	t.Helper()
+
+	desc, err := imageDescriptor(img)
+	if err != nil {
+		t.Fatalf("Failed to get descriptor: %v", err)
+	}
+	return desc
+}
+
+// attachReferrers pushes a cosign signature and attestation tag and an OCI SBOM referrer for img
+func attachReferrers(t *testing.T, repo string, img v1.Image) {
+	t.Helper()
+
+	subject := descriptorOf(t, img)
+	digest := mustDigest(t, repo+"@"+subject.Digest.String())
+
+	for _, suffix := range []string{".sig", ".att"} {
+		artifact, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("Failed to create artifact: %v", err)
+		}
+		if err := remote.Write(cosignTag(digest, suffix), artifact); err != nil {
+			t.Fatalf("Failed to push %s: %v", suffix, err)
+		}
+	}
+
+	sbom, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("Failed to create sbom: %v", err)
+	}
+	sbom = mutate.ConfigMediaType(mutate.MediaType(sbom, types.OCIManifestSchema1), "application/spdx+json")
+	sbom = mutate.Subject(sbom, subject).(v1.Image)
+	sbomDigest, err := sbom.Digest()
+	if err != nil {
+		t.Fatalf("Failed to get sbom digest: %v", err)
+	}
+	if err := remote.Write(digest.Context().Digest(sbomDigest.String()), sbom); err != nil {
+		t.Fatalf("Failed to push sbom: %v", err)
+	}
+}
+
+func TestFindReferrers(t *testing.T) {
+	for _, referrersAPI := range []bool{true, false} {
+		host := newTestRegistry(t, registry.WithReferrersSupport(referrersAPI))
+		repo := host + "/test/signed"
+		img := pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+		attachReferrers(t, repo, img)
+
+		digest, _ := img.Digest()
+		referrers, err := findReferrers(mustDigest(t, repo+"@"+digest.String()), nil)
+		if err != nil {
+			t.Fatalf("Failed to find referrers (referrers API %v): %v", referrersAPI, err)
+		}
+
+		kinds := map[string]int{}
+		for _, r := range referrers {
+			kinds[r.Kind]++
+		}
+		if kinds[ReferrerSignature] != 1 || kinds[ReferrerAttestation] != 1 || kinds[ReferrerSBOM] != 1 {
+			t.Errorf("Expected one signature, attestation and sbom (referrers API %v), got %+v", referrersAPI, referrers)
+		}
+	}
+}
+
+func TestCopyReferrers(t *testing.T) {
+	for _, referrersAPI := range []bool{true, false} {
+		host := newTestRegistry(t, registry.WithReferrersSupport(referrersAPI))
+		repo := host + "/test/signed"
+		img := pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+		attachReferrers(t, repo, img)
+
+		opts := Options{Retry: RetryPolicy{MaxAttempts: 1}, CopyReferrers: true}
+		result := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, opts)
+		if !result.Success || result.Error != "" {
+			t.Fatalf("Update failed (referrers API %v): %s", referrersAPI, result.Error)
+		}
+
+		if len(result.Referrers) != 3 {
+			t.Fatalf("Expected 3 referrers, got %+v", result.Referrers)
+		}
+		for _, r := range result.Referrers {
+			if r.Kind == ReferrerSignature {
+				if r.CopiedTo != "" {
+					t.Errorf("Signature must not be copied, got %s", r.CopiedTo)
+				}
+				continue
+			}
+			if r.CopiedTo == "" {
+				t.Errorf("Expected %s to be copied", r.Reference)
+			}
+		}
+		if len(result.Warnings) != 2 || !strings.Contains(result.Warnings[0], "signature") {
+			t.Errorf("Expected warnings about the orphaned signature and the copied attestation, got %v", result.Warnings)
+		} else if !strings.Contains(result.Warnings[1], "attestation") || !strings.Contains(result.Warnings[1], "still bound to "+result.OldDigest) {
+			t.Errorf("Expected the copied attestation to be reported as bound to the old digest, got %q", result.Warnings[1])
+		}
+
+		copied, err := findReferrers(mustDigest(t, repo+"@"+result.NewDigest), nil)
+		if err != nil {
+			t.Fatalf("Failed to list referrers of the new digest: %v", err)
+		}
+		kinds := map[string]int{}
+		for _, r := range copied {
+			kinds[r.Kind]++
+		}
+		if kinds[ReferrerSignature] != 0 || kinds[ReferrerAttestation] != 1 || kinds[ReferrerSBOM] != 1 {
+			t.Errorf("Expected the attestation and sbom on the new digest (referrers API %v), got %+v", referrersAPI, copied)
+		}
+	}
+}
+
+func TestReferrersReportedWithoutCopy(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/signed"
+	img := pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	attachReferrers(t, repo, img)
+
+	result := removeLabels(repo+":latest", []string{"a"}, nil, Options{Retry: RetryPolicy{MaxAttempts: 1}})
+	if !result.Success {
+		t.Fatalf("Remove failed: %s", result.Error)
+	}
+
+	if len(result.Referrers) != 3 || len(result.Warnings) != 3 {
+		t.Errorf("Expected 3 referrers each with a warning, got %+v and %v", result.Referrers, result.Warnings)
+	}
+	for _, r := range result.Referrers {
+		if r.CopiedTo != "" {
+			t.Errorf("Expected nothing to be copied without --copy-referrers, got %s", r.CopiedTo)
+		}
+	}
+}
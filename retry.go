@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// RetryPolicy controls how registry calls are retried on transient failures
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// defaultRetryPolicy retries each registry step up to 4 times, waiting 1s, 2s, 4s between attempts
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// sleep is overridden in tests to avoid waiting on backoff
+var sleep = time.Sleep
+
+// transientStatusCodes are the HTTP statuses worth retrying
+var transientStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// statusTransport records the Retry-After header of throttled responses so the
+// retry loop can honor it. The error returned by go-containerregistry does not
+// carry response headers, so we need to see the response ourselves.
+type statusTransport struct {
+	inner http.RoundTripper
+	// cache serves manifests and configs by digest when set
+	cache *contentCache
+	// transfer counts the requests made and bytes moved
+	transfer transferCounter
+
+	mu         sync.Mutex
+	retryAfter time.Duration
+}
+
+func newStatusTransport(inner http.RoundTripper) *statusTransport {
+	return &statusTransport{inner: inner}
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cache != nil {
+		if resp := t.cache.lookup(req); resp != nil {
+			t.transfer.cacheHits.Add(1)
+			return resp, nil
+		}
+	}
+
+	t.transfer.requests.Add(1)
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = countingBody{req.Body, &t.transfer.bytesSent}
+	}
+
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		metrics.observeResponse(req.Method, 0)
+		return resp, err
+	}
+	metrics.observeResponse(req.Method, resp.StatusCode)
+	resp.Body = countingBody{resp.Body, &t.transfer.bytesReceived}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.mu.Lock()
+		t.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		t.mu.Unlock()
+	}
+	if t.cache != nil {
+		return t.cache.store(req, resp)
+	}
+	return resp, nil
+}
+
+// takeRetryAfter returns and clears the last Retry-After delay seen
+func (t *statusTransport) takeRetryAfter() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.retryAfter
+	t.retryAfter = 0
+	return d
+}
+
+// parseRetryAfter accepts both forms allowed by RFC 9110: delay-seconds and an HTTP-date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if d := when.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// httpStatus extracts the registry HTTP status from an error, or 0 if there is none
+func httpStatus(err error) int {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode
+	}
+	return 0
+}
+
+// isTransient reports whether err is worth retrying
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if status := httpStatus(err); status != 0 {
+		return transientStatusCodes[status]
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// retrier runs registry steps under a RetryPolicy and records what happened in a Result
+type retrier struct {
+	policy    RetryPolicy
+	transport *statusTransport
+	result    *Result
+}
+
+// do runs fn until it succeeds, fails permanently or runs out of attempts.
+// The number of attempts is recorded under step in result.Attempts, the
+// latency of each attempt in the step duration metric, and the registry
+// traffic so far in result.Transfer.
+func (r *retrier) do(step string, fn func() error) error {
+	maxAttempts := r.policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := r.policy.InitialBackoff
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if r.result.Attempts == nil {
+			r.result.Attempts = make(map[string]int)
+		}
+		r.result.Attempts[step]++
+
+		start := time.Now()
+		err = fn()
+		metrics.observeStep(step, time.Since(start), err)
+		r.result.Transfer = r.transport.transfer.snapshot()
+		if err == nil {
+			r.result.HTTPStatus = 0
+			r.result.Transient = false
+			return nil
+		}
+
+		r.result.HTTPStatus = httpStatus(err)
+		r.result.Transient = isTransient(err)
+		if !r.result.Transient || attempt == maxAttempts {
+			break
+		}
+
+		wait := backoff
+		if retryAfter := r.transport.takeRetryAfter(); retryAfter > 0 {
+			wait = retryAfter
+		}
+		if r.policy.MaxBackoff > 0 && wait > r.policy.MaxBackoff {
+			wait = r.policy.MaxBackoff
+		}
+		sleep(wait)
+
+		backoff *= 2
+		if r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// flakyRegistry serves an in-memory registry that fails the first failures
+// manifest requests with status, setting header on each failure
+func flakyRegistry(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *int32) {
+	var calls int32
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") && r.Method == http.MethodGet {
+			if atomic.AddInt32(&calls, 1) <= failures {
+				for k, v := range header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(status)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	ref, err := name.ParseReference(fmt.Sprintf("%s/test/retry:latest", strings.TrimPrefix(server.URL, "http://")))
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to seed registry: %v", err)
+	}
+	return server, &calls
+}
+
+// recordSleeps replaces sleep for the duration of the test and returns the waits requested
+func recordSleeps(t *testing.T) *[]time.Duration {
+	var waits []time.Duration
+	orig := sleep
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	t.Cleanup(func() { sleep = orig })
+	return &waits
+}
+
+func fetchWithPolicy(t *testing.T, server *httptest.Server, policy RetryPolicy) (Result, error) {
+	ref, err := name.ParseReference(fmt.Sprintf("%s/test/retry:latest", strings.TrimPrefix(server.URL, "http://")))
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	var result Result
+	st := newStatusTransport(http.DefaultTransport)
+	retry := &retrier{policy: policy, transport: st, result: &result}
+	_, _, err = fetchImage(ref, retry, remoteOptions(authn.Anonymous, st))
+	return result, err
+}
+
+func TestRetryTransientThenSuccess(t *testing.T) {
+	waits := recordSleeps(t)
+	server, _ := flakyRegistry(t, 2, http.StatusBadGateway, nil)
+
+	result, err := fetchWithPolicy(t, server, RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("Expected fetch to succeed after retries: %v", err)
+	}
+
+	if result.Attempts["fetch"] != 3 {
+		t.Errorf("Expected 3 fetch attempts, got %d", result.Attempts["fetch"])
+	}
+
+	if result.HTTPStatus != 0 || result.Transient {
+		t.Errorf("Expected failure state to be cleared after success, got status %d transient %v", result.HTTPStatus, result.Transient)
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second}
+	if fmt.Sprint(*waits) != fmt.Sprint(expected) {
+		t.Errorf("Expected backoff %v, got %v", expected, *waits)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	waits := recordSleeps(t)
+	server, _ := flakyRegistry(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"7"}})
+
+	result, err := fetchWithPolicy(t, server, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("Expected fetch to succeed after retry: %v", err)
+	}
+
+	if result.Attempts["fetch"] != 2 {
+		t.Errorf("Expected 2 fetch attempts, got %d", result.Attempts["fetch"])
+	}
+
+	if len(*waits) != 1 || (*waits)[0] != 7*time.Second {
+		t.Errorf("Expected a single 7s wait from Retry-After, got %v", *waits)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	recordSleeps(t)
+	server, calls := flakyRegistry(t, 100, http.StatusServiceUnavailable, nil)
+
+	result, err := fetchWithPolicy(t, server, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected fetch to fail")
+	}
+
+	if atomic.LoadInt32(calls) != 3 || result.Attempts["fetch"] != 3 {
+		t.Errorf("Expected 3 attempts, got %d requests and %d attempts", atomic.LoadInt32(calls), result.Attempts["fetch"])
+	}
+
+	if result.HTTPStatus != http.StatusServiceUnavailable {
+		t.Errorf("Expected http_status 503, got %d", result.HTTPStatus)
+	}
+
+	if !result.Transient {
+		t.Error("Expected failure to be marked transient")
+	}
+}
+
+func TestRetryPermanentFailure(t *testing.T) {
+	waits := recordSleeps(t)
+	server, _ := flakyRegistry(t, 100, http.StatusForbidden, nil)
+
+	result, err := fetchWithPolicy(t, server, defaultRetryPolicy())
+	if err == nil {
+		t.Fatal("Expected fetch to fail")
+	}
+
+	if result.Attempts["fetch"] != 1 {
+		t.Errorf("Expected a single attempt for a permanent failure, got %d", result.Attempts["fetch"])
+	}
+
+	if result.HTTPStatus != http.StatusForbidden || result.Transient {
+		t.Errorf("Expected permanent 403, got status %d transient %v", result.HTTPStatus, result.Transient)
+	}
+
+	if len(*waits) != 0 {
+		t.Errorf("Expected no backoff, got %v", *waits)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-1", 0},
+		{"Mon, 01 Jan 2024 12:00:30 GMT", 30 * time.Second},
+		{"Mon, 01 Jan 2024 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
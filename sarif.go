@@ -0,0 +1,156 @@
+package main
+
+// SARIF 2.1.0 log written by --output sarif. Only the parts label-mod fills in
+// are modelled; see https://docs.oasis-open.org/sarif/sarif/v2.1.0/.
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+)
+
+type sarifReport struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+	Properties  map[string]string `json:"properties,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level Severity `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level   Severity     `json:"level"`
+	Message sarifMessage `json:"message"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     Severity        `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations"`
+}
+
+// sarifLogicalLocation names the label a result is about. Images have no
+// source file, so results carry no physical location.
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// sarifLog converts the findings and policy violations in result to a SARIF
+// log. Failures other than broken rules, e.g. a missing image, are reported as
+// an unsuccessful invocation.
+func sarifLog(result Result) sarifReport {
+	driver := sarifDriver{
+		Name:           "label-mod",
+		Version:        version,
+		InformationURI: "https://github.com/brianwcook/label-mod",
+		Rules:          []sarifRule{},
+	}
+	for _, rule := range lintRules {
+		driver.Rules = append(driver.Rules, sarifRule{
+			ID:                   rule.ID,
+			ShortDescription:     sarifMessage{Text: rule.Description},
+			DefaultConfiguration: sarifConfiguration{Level: rule.Severity},
+		})
+	}
+
+	results := []sarifResult{}
+	for _, finding := range result.Findings {
+		results = append(results, sarifLabelResult(result.ImageRef, finding.Rule, finding.Severity, finding.Label, finding.Message))
+	}
+
+	seen := map[string]bool{}
+	for _, violation := range result.Violations {
+		id := "policy/" + violation.Rule
+		if !seen[id] {
+			seen[id] = true
+			driver.Rules = append(driver.Rules, sarifRule{
+				ID:                   id,
+				ShortDescription:     sarifMessage{Text: "Label policy rule " + violation.Rule},
+				DefaultConfiguration: sarifConfiguration{Level: SeverityError},
+			})
+		}
+		results = append(results, sarifLabelResult(result.ImageRef, id, SeverityError, violation.Label, violation.Message))
+	}
+
+	invocation := sarifInvocation{
+		ExecutionSuccessful: result.Success || result.ErrorCode == ErrLintFailed || result.ErrorCode == ErrPolicyViolation,
+	}
+	if !invocation.ExecutionSuccessful {
+		invocation.ToolExecutionNotifications = []sarifNotification{{
+			Level:   SeverityError,
+			Message: sarifMessage{Text: result.Error},
+		}}
+	}
+
+	run := sarifRun{
+		Tool:        sarifTool{Driver: driver},
+		Invocations: []sarifInvocation{invocation},
+		Results:     results,
+		Properties:  map[string]string{"imageRef": result.ImageRef},
+	}
+	if result.NewDigest != "" {
+		run.Properties["digest"] = result.NewDigest
+	}
+
+	return sarifReport{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []sarifRun{run},
+	}
+}
+
+// sarifLabelResult builds a result located at label in imageRef
+func sarifLabelResult(imageRef, ruleID string, level Severity, label, message string) sarifResult {
+	return sarifResult{
+		RuleID:  ruleID,
+		Level:   level,
+		Message: sarifMessage{Text: message},
+		Locations: []sarifLocation{{
+			LogicalLocations: []sarifLogicalLocation{{
+				Name:               label,
+				FullyQualifiedName: imageRef + "#" + label,
+				Kind:               "member",
+			}},
+		}},
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resultSchemaVersion is written to every Result as schema_version. Bump it
+// whenever a field is removed or changes meaning; adding optional fields does
+// not require a bump.
+const resultSchemaVersion = "1"
+
+// schemaEnums lists the allowed values of string types that form a closed set
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(ErrorCode("")): errorCodeNames(),
+	reflect.TypeOf(Severity("")):  {string(SeverityError), string(SeverityNote), string(SeverityWarning)},
+	reflect.TypeOf(ExpiryStatus("")): {
+		string(ExpiryActive), string(ExpiryExpired), string(ExpiryInvalid), string(ExpiryNone), string(ExpiryUnknown),
+	},
+}
+
+// errorCodeNames returns every known ErrorCode in sorted order
+func errorCodeNames() []string {
+	names := make([]string, 0, len(exitCodes))
+	for code := range exitCodes {
+		names = append(names, string(code))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resultSchema generates the JSON Schema describing Result from its Go type
+func resultSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Result{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "label-mod result"
+	schema["properties"].(map[string]interface{})["schema_version"] = map[string]interface{}{
+		"type":  "string",
+		"const": resultSchemaVersion,
+	}
+	return schema
+}
+
+// resultSchemaJSON returns the indented JSON encoding of resultSchema
+func resultSchemaJSON() ([]byte, error) {
+	return json.MarshalIndent(resultSchema(), "", "  ")
+}
+
+// typeSchema returns the JSON Schema for t following encoding/json rules
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if values, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": values}
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files instead of comparing against them")
+
+// checkGolden compares got with the contents of path, or rewrites path when -update is set
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("Failed to update golden file %s: %v", path, err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file %s (run go test -update to create it): %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Output does not match %s; if the change is deliberate, run go test -update and review the diff.\ngot:\n%s", path, got)
+	}
+}
+
+func TestResultSchemaGolden(t *testing.T) {
+	schema, err := resultSchemaJSON()
+	if err != nil {
+		t.Fatalf("Failed to generate schema: %v", err)
+	}
+	checkGolden(t, filepath.Join("schema", "result.schema.json"), append(schema, '\n'))
+}
+
+func TestResultJSONGolden(t *testing.T) {
+	tests := map[string]Result{
+		"mutation.json": sampleMutationResult(),
+		"failure.json": {
+			ImageRef:   "quay.io/example/app:latest",
+			Error:      "Error getting image: unexpected status code 502 Bad Gateway",
+			ErrorCode:  ErrRegistryUnavailable,
+			Attempts:   map[string]int{"fetch": 4},
+			HTTPStatus: 502,
+			Transient:  true,
+		},
+	}
+
+	for name, result := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeResult(&buf, result, OutputFormat{Kind: OutputJSON}); err != nil {
+				t.Fatalf("Failed to write result: %v", err)
+			}
+			checkGolden(t, filepath.Join("testdata", name), buf.Bytes())
+		})
+	}
+}
+
+func TestResultSchemaCoversResult(t *testing.T) {
+	schema := resultSchema()
+	properties := schema["properties"].(map[string]interface{})
+
+	var buf bytes.Buffer
+	result := sampleMutationResult()
+	result.Error = "x"
+	result.ErrorCode = ErrInternal
+	result.Current = map[string]string{"a": "b"}
+	result.Attempts = map[string]int{"fetch": 1}
+	result.HTTPStatus = 500
+	result.Transient = true
+	if err := writeResult(&buf, result, OutputFormat{Kind: OutputJSON}); err != nil {
+		t.Fatalf("Failed to write result: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("Failed to parse result: %v", err)
+	}
+	for field := range fields {
+		if _, ok := properties[field]; !ok {
+			t.Errorf("Result field %s is missing from the schema", field)
+		}
+	}
+
+	if fields["schema_version"] != resultSchemaVersion {
+		t.Errorf("Expected schema_version %s, got %v", resultSchemaVersion, fields["schema_version"])
+	}
+}
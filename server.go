@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// Server defaults, overridable with serve flags
+const (
+	defaultListenAddr    = ":8080"
+	defaultMaxConcurrent = 4
+	maxRequestBody       = 1 << 20
+	shutdownTimeout      = 30 * time.Second
+)
+
+// httpStatuses maps error codes to the HTTP status returned by serve
+var httpStatuses = map[ErrorCode]int{
+	ErrInvalidArguments:    http.StatusBadRequest,
+	ErrInvalidReference:    http.StatusBadRequest,
+	ErrDigestRefNeedsTag:   http.StatusBadRequest,
+	ErrAuthFailed:          http.StatusUnauthorized,
+	ErrNotFound:            http.StatusNotFound,
+	ErrNothingToChange:     http.StatusConflict,
+	ErrPushDenied:          http.StatusForbidden,
+	ErrPreconditionFailed:  http.StatusPreconditionFailed,
+	ErrPolicyViolation:     http.StatusUnprocessableEntity,
+	ErrLintFailed:          http.StatusUnprocessableEntity,
+	ErrDriftDetected:       http.StatusConflict,
+	ErrRegistryUnavailable: http.StatusServiceUnavailable,
+	ErrRegistryError:       http.StatusBadGateway,
+}
+
+// labelPatch is the body of PATCH /images/{ref}/labels
+type labelPatch struct {
+	Remove []string          `json:"remove,omitempty"`
+	Update map[string]string `json:"update,omitempty"`
+	Tags   []string          `json:"tags,omitempty"`
+}
+
+// server exposes the label-mod commands over HTTP
+type server struct {
+	opts Options
+	sem  chan struct{}
+}
+
+// newServer returns a server running at most maxConcurrent registry operations
+// at once. The content cache is off: an entry one caller was allowed to read
+// would otherwise be served to callers the registry would refuse.
+func newServer(opts Options, maxConcurrent int) *server {
+	opts.CacheDir = ""
+	return &server{opts: opts, sem: make(chan struct{}, maxConcurrent)}
+}
+
+// handler returns the HTTP routes of the server
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/", s.handleImage)
+	mux.HandleFunc("/batch", s.handleBatch)
+	return mux
+}
+
+// handleImage serves GET and PATCH /images/{ref}/labels. The reference keeps
+// its slashes, e.g. /images/quay.io/org/app:latest/labels.
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	imageRef, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/labels")
+	if !ok || imageRef == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.run(w, r, "test", func(opts Options) interface{} {
+			return testImage(imageRef, opts)
+		})
+
+	case http.MethodPatch:
+		var patch labelPatch
+		if err := decodeBody(w, r, &patch); err != nil {
+			writeResultResponse(w, Result{ImageRef: imageRef, Error: err.Error(), ErrorCode: ErrInvalidArguments})
+			return
+		}
+		if len(patch.Remove) == 0 && len(patch.Update) == 0 {
+			writeResultResponse(w, Result{ImageRef: imageRef, Error: "Nothing to change: set remove or update", ErrorCode: ErrInvalidArguments})
+			return
+		}
+		s.run(w, r, "modify-labels", func(opts Options) interface{} {
+			return modifyLabels(imageRef, patch.Remove, patch.Update, patch.Tags, opts)
+		})
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBatch serves POST /batch with a batch in the body
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	var batch *Batch
+	if err == nil {
+		batch, err = parseBatch(data)
+	}
+	if err != nil {
+		writeResultResponse(w, Result{Error: fmt.Sprintf("Invalid batch: %v", err), ErrorCode: ErrInvalidArguments})
+		return
+	}
+
+	s.run(w, r, "batch", func(opts Options) interface{} {
+		return runBatch(batch, opts)
+	})
+}
+
+// run executes command through fn with the request's credentials once a
+// concurrency slot is free, and writes what it returns
+func (s *server) run(w http.ResponseWriter, r *http.Request, command string, fn func(Options) interface{}) {
+	keychain, err := requestKeychain(r)
+	if err != nil {
+		writeResultResponse(w, Result{Error: err.Error(), ErrorCode: ErrAuthFailed})
+		return
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-r.Context().Done():
+		return
+	}
+
+	opts := s.opts
+	opts.Keychain = keychain
+
+	switch v := fn(opts).(type) {
+	case Result:
+		metrics.observeOperation(command, v)
+		writeResultResponse(w, v)
+	case []Result:
+		for _, result := range v {
+			metrics.observeOperation(command, result)
+		}
+		writeResultsResponse(w, v)
+	}
+}
+
+// staticKeychain resolves every registry to the same credentials
+type staticKeychain struct {
+	auth authn.Authenticator
+}
+
+func (k staticKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.auth, nil
+}
+
+// requestKeychain returns the registry credentials sent with the request as
+// Basic or Bearer authorization. Requests without credentials are anonymous;
+// the server's own credentials are never used on a caller's behalf.
+func requestKeychain(r *http.Request) (authn.Keychain, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return staticKeychain{authn.Anonymous}, nil
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return staticKeychain{&authn.Basic{Username: username, Password: password}}, nil
+	}
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok && token != "" {
+		return staticKeychain{&authn.Bearer{Token: token}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported Authorization header: expected Basic or Bearer credentials")
+}
+
+// decodeBody decodes a JSON request body into v, rejecting unknown fields
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("Invalid request body: %v", err)
+	}
+	return nil
+}
+
+// resultStatus returns the HTTP status for result
+func resultStatus(result Result) int {
+	if result.Success {
+		return http.StatusOK
+	}
+	if status, ok := httpStatuses[result.ErrorCode]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeResultResponse writes result as JSON with the status matching its error code
+func writeResultResponse(w http.ResponseWriter, result Result) {
+	result.SchemaVersion = resultSchemaVersion
+	writeJSON(w, resultStatus(result), result)
+}
+
+// writeResultsResponse writes results as a JSON array. The status is that of
+// the first failed result, or 200 when every result succeeded.
+func writeResultsResponse(w http.ResponseWriter, results []Result) {
+	status := http.StatusOK
+	for i := range results {
+		results[i].SchemaVersion = resultSchemaVersion
+		if status == http.StatusOK && !results[i].Success {
+			status = resultStatus(results[i])
+		}
+	}
+	writeJSON(w, status, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// serve runs the HTTP API on addr until SIGINT or SIGTERM
+func serve(addr string, maxConcurrent int, opts Options) error {
+	return listenAndServe(addr, newServer(opts, maxConcurrent).handler())
+}
+
+// listenAndServe serves handler on addr until SIGINT or SIGTERM, then waits
+// for requests in flight to finish before returning
+func listenAndServe(addr string, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var ready atomic.Bool
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           withObservability(handler, &ready),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("label-mod %s listening on %s", version, listener.Addr())
+		errs <- srv.Serve(listener)
+	}()
+	ready.Store(true)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	ready.Store(false)
+
+	log.Printf("Shutting down, waiting up to %s for requests in flight", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// parseServeArgs returns the listen address and concurrency limit given to serve
+func parseServeArgs(args []string) (string, int, error) {
+	addr := defaultListenAddr
+	maxConcurrent := defaultMaxConcurrent
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--listen" && i+1 < len(args):
+			addr = args[i+1]
+			i++ // skip the address
+		case args[i] == "--max-concurrent" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return "", 0, fmt.Errorf("Invalid value for --max-concurrent: %s", args[i+1])
+			}
+			maxConcurrent = n
+			i++ // skip the limit
+		default:
+			return "", 0, fmt.Errorf("Unknown serve argument: %s", args[i])
+		}
+	}
+
+	return addr, maxConcurrent, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// newTestServer starts the API server and returns its base URL
+func newTestServer(t *testing.T) string {
+	server := httptest.NewServer(newServer(Options{}, 2).handler())
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// request sends body to url and decodes the JSON response into v
+func request(t *testing.T, method, url, body string, v interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServeLabels(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/serve"
+	pushTestImage(t, repo+":latest", map[string]string{"quay.expires-after": "1w", "team": "a"})
+	api := newTestServer(t)
+
+	var result Result
+	if status := request(t, http.MethodGet, api+"/images/"+repo+":latest/labels", "", &result); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %+v", status, result)
+	}
+	if result.Current["team"] != "a" || result.SchemaVersion != resultSchemaVersion {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	body := `{"remove": ["quay.expires-after"], "update": {"team": "b"}, "tags": ["stable"]}`
+	result = Result{}
+	if status := request(t, http.MethodPatch, api+"/images/"+repo+":latest/labels", body, &result); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %+v", status, result)
+	}
+	if result.NewDigest == "" || len(result.TaggedAs) != 1 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	result = Result{}
+	if status := request(t, http.MethodGet, api+"/images/"+repo+":missing/labels", "", &result); status != http.StatusNotFound || result.ErrorCode != ErrNotFound {
+		t.Errorf("Expected 404 not-found, got %d: %+v", status, result)
+	}
+
+	result = Result{}
+	if status := request(t, http.MethodPatch, api+"/images/"+repo+":latest/labels", `{"delete": ["a"]}`, &result); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown field, got %d: %+v", status, result)
+	}
+
+	if status := request(t, http.MethodDelete, api+"/images/"+repo+":latest/labels", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", status)
+	}
+}
+
+func TestServeDoesNotShareCachedImages(t *testing.T) {
+	host := privateRegistry(t)
+	repo := host + "/test/private/app"
+	pushTestImage(t, repo+":latest", map[string]string{"secret": "label"})
+	ref := repo + "@" + tagDigest(t, repo+":latest")
+
+	cacheDir := t.TempDir()
+	server := httptest.NewServer(newServer(Options{CacheDir: cacheDir}, 2).handler())
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/images/"+ref+"/labels", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.SetBasicAuth("user", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the authorized caller to read the labels, got %d", resp.StatusCode)
+	}
+
+	var result Result
+	if status := request(t, http.MethodGet, server.URL+"/images/"+ref+"/labels", "", &result); status != http.StatusUnauthorized || result.Current["secret"] != "" {
+		t.Errorf("Expected an anonymous caller to be refused, got %d: %+v", status, result)
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("Expected serve not to use the cache, got %d entries", len(entries))
+	}
+	if w := newWatcher(&WebhookConfig{}, Options{CacheDir: cacheDir}, &bytes.Buffer{}); w.opts.CacheDir != "" {
+		t.Error("Expected watch-webhooks not to use the cache")
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	host := newTestRegistry(t)
+	pushTestImage(t, host+"/test/app:1", map[string]string{"quay.expires-after": "1w"})
+	api := newTestServer(t)
+
+	body := `{"items": [{"command": "remove-labels", "image_ref": "` + host + `/test/app:1", "remove": ["quay.expires-after"]}]}`
+	var results []Result
+	if status := request(t, http.MethodPost, api+"/batch", body, &results); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %+v", status, results)
+	}
+	if len(results) != 1 || !results[0].Success {
+		t.Errorf("Unexpected results %+v", results)
+	}
+
+	var result Result
+	if status := request(t, http.MethodPost, api+"/batch", `{"items": []}`, &result); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty batch, got %d", status)
+	}
+}
+
+func TestRequestKeychain(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("robot", "secret")
+	keychain, err := requestKeychain(req)
+	if err != nil {
+		t.Fatalf("Failed to resolve basic credentials: %v", err)
+	}
+	auth, _ := keychain.Resolve(nil)
+	if cfg, _ := auth.Authorization(); cfg.Username != "robot" || cfg.Password != "secret" {
+		t.Errorf("Unexpected credentials %+v", cfg)
+	}
+
+	req.Header.Set("Authorization", "Bearer token")
+	keychain, _ = requestKeychain(req)
+	auth, _ = keychain.Resolve(nil)
+	if cfg, _ := auth.Authorization(); cfg.RegistryToken != "token" {
+		t.Errorf("Unexpected credentials %+v", cfg)
+	}
+
+	req.Header.Del("Authorization")
+	keychain, _ = requestKeychain(req)
+	if auth, _ := keychain.Resolve(nil); auth != authn.Anonymous {
+		t.Errorf("Expected anonymous access without credentials, got %v", auth)
+	}
+
+	req.Header.Set("Authorization", "Digest abc")
+	if _, err := requestKeychain(req); err == nil {
+		t.Error("Expected unsupported schemes to be rejected")
+	}
+}
+
+func TestParseServeArgs(t *testing.T) {
+	addr, n, err := parseServeArgs([]string{"--listen", "127.0.0.1:9000", "--max-concurrent", "8"})
+	if err != nil || addr != "127.0.0.1:9000" || n != 8 {
+		t.Errorf("Unexpected %s %d %v", addr, n, err)
+	}
+	if _, _, err := parseServeArgs([]string{"--max-concurrent", "0"}); err == nil {
+		t.Error("Expected a zero limit to be rejected")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media type and annotation used by cosign for simple signing signatures
+const (
+	simpleSigningMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnno                    = "dev.cosignproject.cosign/signature"
+	simpleSigningType                      = "cosign container image signature"
+)
+
+// simpleSigning is the cosign flavour of the containers/image simple signing payload
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// loadSigningKey reads an unencrypted ECDSA or Ed25519 private key from a PEM file.
+// Password protected cosign keys need a KMS or the password, neither of which
+// fits offline use, so they are rejected with a hint.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		return nil, fmt.Errorf("%s is password protected; export an unencrypted PKCS#8 key instead", path)
+	default:
+		return nil, fmt.Errorf("%s contains an unsupported %q block", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s must hold an ECDSA or Ed25519 key, got %T", path, key)
+}
+
+// simpleSigningPayload returns the payload cosign signs for digest in repo
+func simpleSigningPayload(repo name.Repository, digest v1.Hash) ([]byte, error) {
+	var payload simpleSigning
+	payload.Critical.Identity.DockerReference = repo.Name()
+	payload.Critical.Image.DockerManifestDigest = digest.String()
+	payload.Critical.Type = simpleSigningType
+	return json.Marshal(payload)
+}
+
+// signPayload signs payload the way cosign verifies it: ECDSA signs the SHA-256
+// of the payload, Ed25519 signs the payload itself
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	sum := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
+
+// signImage signs digest in repo with key and pushes the signature to the
+// cosign signature tag, appending to any signatures already there. It returns
+// the digest reference of the pushed signature manifest.
+func signImage(key crypto.Signer, repo name.Repository, digest v1.Hash, remoteOpts []remote.Option) (name.Digest, error) {
+	payload, err := simpleSigningPayload(repo, digest)
+	if err != nil {
+		return name.Digest{}, err
+	}
+	signature, err := signPayload(key, payload)
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	tag := cosignTag(repo.Digest(digest.String()), ".sig")
+
+	base, err := remote.Image(tag, remoteOpts...)
+	if err != nil {
+		if !isNotFound(err) {
+			return name.Digest{}, err
+		}
+		base = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	}
+
+	sigImg, err := mutate.Append(base, mutate.Addendum{
+		Layer: static.NewLayer(payload, simpleSigningMediaType),
+		Annotations: map[string]string{
+			cosignSignatureAnno: base64.StdEncoding.EncodeToString(signature),
+		},
+	})
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	if err := remote.Write(tag, sigImg, remoteOpts...); err != nil {
+		return name.Digest{}, err
+	}
+
+	sigDigest, err := sigImg.Digest()
+	if err != nil {
+		return name.Digest{}, err
+	}
+	return repo.Digest(sigDigest.String()), nil
+}
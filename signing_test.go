@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// writeKey writes key as a PKCS#8 PEM file and returns its path
+func writeKey(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+func TestSignKeyPushesVerifiableSignature(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			host := newTestRegistry(t)
+			repo := host + "/test/signed"
+			pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+			opts := Options{Retry: RetryPolicy{MaxAttempts: 1}, SignKey: writeKey(t, key)}
+			result := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, opts)
+			if !result.Success || result.Error != "" {
+				t.Fatalf("Update failed: %s", result.Error)
+			}
+			if result.SignatureDigest == "" || result.SignatureTag == "" {
+				t.Fatalf("Expected signature to be reported, got %+v", result)
+			}
+
+			verifySignature(t, result, key.Public())
+		})
+	}
+}
+
+// verifySignature checks the cosign signature tag of result.NewDigest against pub
+func verifySignature(t *testing.T, result Result, pub crypto.PublicKey) {
+	t.Helper()
+
+	tag, err := name.ParseReference(result.SignatureTag)
+	if err != nil {
+		t.Fatalf("Failed to parse signature tag: %v", err)
+	}
+	sigImg, err := remote.Image(tag)
+	if err != nil {
+		t.Fatalf("Failed to fetch signature: %v", err)
+	}
+	sigDigest, _ := sigImg.Digest()
+	if sigDigest.String() != result.SignatureDigest {
+		t.Errorf("Expected signature digest %s, got %s", result.SignatureDigest, sigDigest)
+	}
+
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		t.Fatalf("Failed to read signature manifest: %v", err)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != simpleSigningMediaType {
+		t.Fatalf("Expected a single simple signing layer, got %+v", manifest.Layers)
+	}
+	signature, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations[cosignSignatureAnno])
+	if err != nil {
+		t.Fatalf("Failed to decode signature: %v", err)
+	}
+
+	layers, _ := sigImg.Layers()
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read payload: %v", err)
+	}
+	payload, _ := io.ReadAll(rc)
+	rc.Close()
+
+	var parsed simpleSigning
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		t.Fatalf("Failed to parse payload: %v", err)
+	}
+	if parsed.Critical.Image.DockerManifestDigest != result.NewDigest {
+		t.Errorf("Expected payload to name %s, got %s", result.NewDigest, parsed.Critical.Image.DockerManifestDigest)
+	}
+	if parsed.Critical.Type != simpleSigningType {
+		t.Errorf("Unexpected payload type %q", parsed.Critical.Type)
+	}
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(k, sum[:], signature) {
+			t.Error("ECDSA signature does not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, signature) {
+			t.Error("Ed25519 signature does not verify")
+		}
+	}
+}
+
+func TestLoadSigningKeyRejectsUnsupportedKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	encrypted := filepath.Join(dir, "cosign.key")
+	os.WriteFile(encrypted, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: []byte("x")}), 0o600)
+	if _, err := loadSigningKey(encrypted); err == nil {
+		t.Error("Expected encrypted cosign keys to be rejected")
+	}
+
+	notPEM := filepath.Join(dir, "garbage")
+	os.WriteFile(notPEM, []byte("not a key"), 0o600)
+	if _, err := loadSigningKey(notPEM); err == nil {
+		t.Error("Expected non-PEM files to be rejected")
+	}
+}
+
+func TestSignKeyFailsBeforePush(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/signed"
+	img := pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+	before, _ := img.Digest()
+
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, Options{SignKey: filepath.Join(t.TempDir(), "missing.pem")})
+	if result.Success || result.ErrorCode != ErrInvalidArguments {
+		t.Fatalf("Expected invalid-arguments for a missing key, got %+v", result)
+	}
+
+	desc, err := remote.Head(mustTag(t, repo+":latest"))
+	if err != nil {
+		t.Fatalf("Failed to read tag: %v", err)
+	}
+	if desc.Digest != before {
+		t.Errorf("Expected the tag to be untouched, got %s", desc.Digest)
+	}
+}
+
+func TestSignatureFailureIsNotSuccess(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyPath := writeKey(t, key)
+
+	repo := refusingRegistry(t, pushesTo(".sig")) + "/test/signed"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, Options{SignKey: keyPath})
+	if result.Success || result.ErrorCode != ErrPushDenied {
+		t.Fatalf("Expected push-denied for the refused signature, got %+v", result)
+	}
+
+	if got := exitStatus(t, "update-labels", repo+":latest", "a=d", "--sign-key", keyPath); got != exitCode(ErrPushDenied) {
+		t.Errorf("Expected exit status %d, got %d", exitCode(ErrPushDenied), got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Transfer counts the registry traffic of an operation. Byte counts cover
+// request and response bodies; responses served from the content cache are
+// counted separately and move no bytes.
+type Transfer struct {
+	Requests      int64 `json:"requests"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	CacheHits     int64 `json:"cache_hits,omitempty"`
+}
+
+// transferCounter accumulates a Transfer from concurrent requests
+type transferCounter struct {
+	requests      atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	cacheHits     atomic.Int64
+}
+
+// snapshot returns the traffic counted so far
+func (c *transferCounter) snapshot() *Transfer {
+	return &Transfer{
+		Requests:      c.requests.Load(),
+		BytesSent:     c.bytesSent.Load(),
+		BytesReceived: c.bytesReceived.Load(),
+		CacheHits:     c.cacheHits.Load(),
+	}
+}
+
+// add merges other into t, for results that share fetches
+func (t *Transfer) add(other *Transfer) *Transfer {
+	if other == nil {
+		return t
+	}
+	if t == nil {
+		t = &Transfer{}
+	}
+	t.Requests += other.Requests
+	t.BytesSent += other.BytesSent
+	t.BytesReceived += other.BytesReceived
+	t.CacheHits += other.CacheHits
+	return t
+}
+
+// countingBody counts the bytes read from a request or response body into n
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// strictImage refuses to read the content of any layer of the wrapped image.
+// go-containerregistry only reads a layer to upload it when the target
+// repository lacks it, so with --strict-no-blobs a push that would upload
+// or download a layer fails instead.
+type strictImage struct {
+	v1.Image
+}
+
+func (i strictImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	strict := make([]v1.Layer, len(layers))
+	for n, layer := range layers {
+		strict[n] = strictLayer{layer}
+	}
+	return strict, nil
+}
+
+func (i strictImage) LayerByDigest(digest v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return strictLayer{layer}, nil
+}
+
+func (i strictImage) LayerByDiffID(diffID v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDiffID(diffID)
+	if err != nil {
+		return nil, err
+	}
+	return strictLayer{layer}, nil
+}
+
+// strictLayer is a layer whose content may not be transferred
+type strictLayer struct {
+	v1.Layer
+}
+
+func (l strictLayer) Compressed() (io.ReadCloser, error) {
+	return nil, l.refuse()
+}
+
+func (l strictLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, l.refuse()
+}
+
+func (l strictLayer) refuse() error {
+	digest, _ := l.Digest()
+	return newError(ErrBlobTransfer, "--strict-no-blobs: refusing to transfer layer %s", digest)
+}
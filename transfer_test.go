@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestTransferIsRecorded(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/transfer"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	opts := Options{CacheDir: t.TempDir()}
+	first := testImage(repo+":latest", opts)
+	if first.Transfer == nil || first.Transfer.Requests == 0 || first.Transfer.BytesReceived == 0 {
+		t.Fatalf("Expected the fetch to be counted, got %+v", first.Transfer)
+	}
+	if first.Transfer.BytesSent != 0 || first.Transfer.CacheHits != 0 {
+		t.Errorf("Expected a cold read to send nothing and miss the cache, got %+v", first.Transfer)
+	}
+
+	second := testImage(repo+":latest", opts)
+	if second.Transfer.CacheHits != 2 || second.Transfer.BytesReceived >= first.Transfer.BytesReceived {
+		t.Errorf("Expected the manifest and config to come from the cache, got %+v", second.Transfer)
+	}
+
+	updated := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, Options{StrictNoBlobs: true})
+	if !updated.Success {
+		t.Fatalf("Expected a relabel within the repository to need no layers, got %+v", updated)
+	}
+	if updated.Transfer == nil || updated.Transfer.BytesSent == 0 {
+		t.Errorf("Expected the pushed manifest and config to be counted, got %+v", updated.Transfer)
+	}
+}
+
+func TestUndoReadsThroughTheCache(t *testing.T) {
+	host := newTestRegistry(t)
+	repo := host + "/test/transfer"
+	pushTestImage(t, repo+":latest", map[string]string{"a": "b"})
+
+	opts := Options{CacheDir: t.TempDir(), Journal: filepath.Join(t.TempDir(), "journal.jsonl")}
+	updated := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, opts)
+	if !updated.Success {
+		t.Fatalf("Update failed: %+v", updated)
+	}
+
+	// The old manifest was cached when it was read for the update
+	result := undoOperation(updated.Operation, opts)
+	if !result.Success {
+		t.Fatalf("Undo failed: %+v", result)
+	}
+	if result.Transfer == nil || result.Transfer.Requests == 0 || result.Transfer.CacheHits != 1 {
+		t.Errorf("Expected the undo to be counted and restore the old manifest from the cache, got %+v", result.Transfer)
+	}
+}
+
+func TestStrictNoBlobsRefusesLayerUploads(t *testing.T) {
+	img := pushTestImage(t, newTestRegistry(t)+"/test/source:latest", map[string]string{"a": "b"})
+
+	// Push the manifest and config to a registry that lacks the layers
+	repo := newTestRegistry(t) + "/test/missing-layers"
+	config, err := partial.ConfigLayer(img)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if err := remote.WriteLayer(mustTag(t, repo+":latest").Context(), config); err != nil {
+		t.Fatalf("Failed to push config: %v", err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	mediaType, _ := img.MediaType()
+	if err := remote.Put(mustTag(t, repo+":latest"), rawManifest{data: raw, mediaType: mediaType}); err != nil {
+		t.Fatalf("Failed to push manifest: %v", err)
+	}
+	before := tagDigest(t, repo+":latest")
+
+	result := updateLabels(repo+":latest", map[string]string{"a": "c"}, nil, Options{StrictNoBlobs: true})
+	if result.Success || result.ErrorCode != ErrBlobTransfer {
+		t.Fatalf("Expected blob-transfer, got %+v", result)
+	}
+	if tagDigest(t, repo+":latest") != before {
+		t.Error("Expected the tag to be untouched")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"sigs.k8s.io/yaml"
+)
+
+// Webhook endpoints served by watch-webhooks
+const (
+	distributionWebhookPath = "/webhooks/distribution"
+	quayWebhookPath         = "/webhooks/quay"
+)
+
+// dedupeWindow is how long a processed event or pushed digest is remembered
+const dedupeWindow = 10 * time.Minute
+
+// webhookQueueSize bounds the pushes waiting to be processed
+const webhookQueueSize = 100
+
+// webhookTokenHeader carries the shared secret of a webhook request; registries
+// that cannot send headers pass it as the token query parameter instead
+const webhookTokenHeader = "X-Label-Mod-Token"
+
+// webhookSecretEnv sets the shared secret when the rules file does not
+const webhookSecretEnv = "LABEL_MOD_WEBHOOK_SECRET"
+
+// WebhookConfig holds the label rules applied to newly pushed images
+type WebhookConfig struct {
+	// Registry replaces the host in Docker Distribution events, for registries
+	// that see themselves under a different name than label-mod does. Events
+	// for images on any other registry are ignored.
+	Registry string `json:"registry,omitempty"`
+	// Secret must be sent with every event
+	Secret string        `json:"secret,omitempty"`
+	Rules  []WebhookRule `json:"rules"`
+}
+
+// WebhookRule changes the labels of pushed tags matching Tags in repositories
+// matching Repositories (every repository when empty). Both are globs as in
+// policy files.
+type WebhookRule struct {
+	Name         string            `json:"name,omitempty"`
+	Repositories []string          `json:"repositories,omitempty"`
+	Tags         string            `json:"tags,omitempty"`
+	Remove       []string          `json:"remove,omitempty"`
+	Update       map[string]string `json:"update,omitempty"`
+
+	repositories []*regexp.Regexp
+	tags         *regexp.Regexp
+}
+
+// pushEvent is a tag push reported by a registry webhook
+type pushEvent struct {
+	ID        string
+	ImageRef  string
+	Digest    string
+	UserAgent string
+}
+
+// distributionEnvelope is the body of a Docker Distribution notification
+type distributionEnvelope struct {
+	Events []struct {
+		ID     string `json:"id"`
+		Action string `json:"action"`
+		Target struct {
+			MediaType  string `json:"mediaType"`
+			Digest     string `json:"digest"`
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+			URL        string `json:"url"`
+		} `json:"target"`
+		Request struct {
+			Host      string `json:"host"`
+			UserAgent string `json:"useragent"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+// quayPushEvent is the body of a Quay repository push notification
+type quayPushEvent struct {
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+// loadWebhookConfig reads and compiles a webhook rules file
+func loadWebhookConfig(path string) (*WebhookConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config WebhookConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+	if config.Secret == "" {
+		config.Secret = os.Getenv(webhookSecretEnv)
+	}
+	if config.Registry != "" {
+		if _, err := name.NewRegistry(config.Registry); err != nil {
+			return nil, fmt.Errorf("Invalid registry %q: %v", config.Registry, err)
+		}
+	}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		if len(rule.Remove) == 0 && len(rule.Update) == 0 {
+			return nil, fmt.Errorf("%s has nothing to remove or update", rule.Name)
+		}
+		for _, pattern := range rule.Repositories {
+			rule.repositories = append(rule.repositories, globToRegexp(pattern))
+		}
+		if rule.Tags != "" {
+			rule.tags = globToRegexp(rule.Tags)
+		}
+	}
+	return &config, nil
+}
+
+// matches reports whether the rule applies to tag
+func (r *WebhookRule) matches(tag name.Tag) bool {
+	if r.tags != nil && !r.tags.MatchString(tag.TagStr()) {
+		return false
+	}
+	if len(r.repositories) == 0 {
+		return true
+	}
+	for _, re := range r.repositories {
+		if re.MatchString(tag.Context().Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDistributionEvents returns the tag pushes in a Docker Distribution
+// notification. Blob pushes and pushes by digest carry no tag and are skipped.
+func parseDistributionEvents(data []byte, registry string) ([]pushEvent, error) {
+	var envelope distributionEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+
+	var events []pushEvent
+	for _, e := range envelope.Events {
+		if e.Action != "push" || e.Target.Tag == "" {
+			continue
+		}
+		host := registry
+		if host == "" {
+			host = e.Request.Host
+		}
+		if host == "" {
+			if u, err := url.Parse(e.Target.URL); err == nil {
+				host = u.Host
+			}
+		}
+		events = append(events, pushEvent{
+			ID:        e.ID,
+			ImageRef:  fmt.Sprintf("%s/%s:%s", host, e.Target.Repository, e.Target.Tag),
+			Digest:    e.Target.Digest,
+			UserAgent: e.Request.UserAgent,
+		})
+	}
+	return events, nil
+}
+
+// parseQuayEvent returns a push per updated tag in a Quay push notification.
+// Quay does not report digests, so they are resolved when the event is processed.
+func parseQuayEvent(data []byte) ([]pushEvent, error) {
+	var event quayPushEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	if event.DockerURL == "" {
+		return nil, fmt.Errorf("missing docker_url")
+	}
+
+	events := make([]pushEvent, 0, len(event.UpdatedTags))
+	for _, tag := range event.UpdatedTags {
+		events = append(events, pushEvent{ImageRef: event.DockerURL + ":" + tag})
+	}
+	return events, nil
+}
+
+// watcher applies webhook rules to pushed images, one at a time
+type watcher struct {
+	config *WebhookConfig
+	opts   Options
+	output io.Writer
+	queue  chan pushEvent
+	done   chan struct{}
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	ours map[string]time.Time
+}
+
+// newWatcher returns a watcher applying config. As in serve, the content cache
+// is off, since the images are named by whoever sends the events.
+func newWatcher(config *WebhookConfig, opts Options, output io.Writer) *watcher {
+	opts.CacheDir = ""
+	return &watcher{
+		config: config,
+		opts:   opts,
+		output: output,
+		queue:  make(chan pushEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+		seen:   make(map[string]time.Time),
+		ours:   make(map[string]time.Time),
+	}
+}
+
+// handler returns the webhook routes of the watcher
+func (w *watcher) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(distributionWebhookPath, w.receive(func(data []byte) ([]pushEvent, error) {
+		return parseDistributionEvents(data, w.config.Registry)
+	}))
+	mux.HandleFunc(quayWebhookPath, w.receive(parseQuayEvent))
+	return mux
+}
+
+// receive returns a handler queueing the pushes parse finds in the request.
+// Registries only need to know the event was accepted, so it is processed after
+// the response.
+func (w *watcher) receive(parse func([]byte) ([]pushEvent, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !w.authorized(r) {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxRequestBody))
+		var events []pushEvent
+		if err == nil {
+			events, err = parse(data)
+		}
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("invalid event: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		for _, event := range events {
+			if !w.onRegistry(event) {
+				log.Printf("Ignoring push of %s: not on %s", event.ImageRef, w.config.Registry)
+				continue
+			}
+			if !w.accept(event) {
+				continue
+			}
+			select {
+			case w.queue <- event:
+			default:
+				log.Printf("Dropping push of %s: queue is full", event.ImageRef)
+			}
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// authorized reports whether the request carries the shared secret, in the
+// token header or query parameter. Without a secret nothing is authorized.
+func (w *watcher) authorized(r *http.Request) bool {
+	if w.config.Secret == "" {
+		return false
+	}
+	token := r.Header.Get(webhookTokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.config.Secret)) == 1
+}
+
+// onRegistry reports whether the pushed image is on the configured registry,
+// so a forged event cannot point label-mod at another host
+func (w *watcher) onRegistry(event pushEvent) bool {
+	if w.config.Registry == "" {
+		return false
+	}
+	registry, err := name.NewRegistry(w.config.Registry)
+	if err != nil {
+		return false
+	}
+	tag, err := name.NewTag(event.ImageRef)
+	return err == nil && tag.RegistryStr() == registry.RegistryStr()
+}
+
+// accept reports whether an event is new and was not caused by label-mod
+func (w *watcher) accept(event pushEvent) bool {
+	if strings.Contains(event.UserAgent, "label-mod/") {
+		return false
+	}
+	if event.Digest != "" && w.remembered(w.ours, event.Digest) {
+		return false
+	}
+	if event.ID != "" && !w.remember(w.seen, "event:"+event.ID) {
+		return false
+	}
+	return true
+}
+
+// remember records key in set and reports whether it was new. Entries older
+// than dedupeWindow are forgotten.
+func (w *watcher) remember(set map[string]time.Time, key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range set {
+		if now.Sub(t) > dedupeWindow {
+			delete(set, k)
+		}
+	}
+	if _, ok := set[key]; ok {
+		return false
+	}
+	set[key] = now
+	return true
+}
+
+// remembered reports whether key is in set
+func (w *watcher) remembered(set map[string]time.Time, key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t, ok := set[key]
+	return ok && time.Since(t) <= dedupeWindow
+}
+
+// process applies the rules matching event to the pushed image. It returns
+// nil when there is nothing to do: no rule matches, the image was pushed by
+// label-mod, it was already processed, or it already complies.
+func (w *watcher) process(event pushEvent) *Result {
+	tag, err := name.NewTag(event.ImageRef)
+	if err != nil {
+		return &Result{ImageRef: event.ImageRef, Error: fmt.Sprintf("Error parsing image reference: %v", err), ErrorCode: ErrInvalidReference}
+	}
+
+	target := newDesiredTarget(event.ImageRef)
+	matched := false
+	for i := range w.config.Rules {
+		rule := &w.config.Rules[i]
+		if rule.matches(tag) {
+			matched = true
+			target.merge(rule.Remove, rule.Update)
+		}
+	}
+	if !matched {
+		return nil
+	}
+
+	current, info := inspectImage(event.ImageRef, w.opts)
+	if !current.Success {
+		return &current
+	}
+	if w.remembered(w.ours, current.OldDigest) || !w.remember(w.seen, event.ImageRef+"@"+current.OldDigest) {
+		return nil
+	}
+
+	drift := target.drift(current.Current, info.annotations)
+	if len(drift) == 0 {
+		return nil
+	}
+
+	result := target.apply(drift, current.OldDigest, w.opts)
+	if result.NewDigest != "" {
+		w.remember(w.ours, result.NewDigest)
+	}
+	return &result
+}
+
+// start processes queued pushes in the background until stop is called
+func (w *watcher) start() {
+	go func() {
+		defer close(w.done)
+		for event := range w.queue {
+			if result := w.process(event); result != nil {
+				metrics.observeOperation("watch-webhooks", *result)
+				if err := writeResult(w.output, *result, w.opts.Output); err != nil {
+					log.Printf("Error writing result: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop waits for the queued pushes to be processed
+func (w *watcher) stop() {
+	close(w.queue)
+	<-w.done
+}
+
+// watchWebhooks serves the webhook endpoints on addr until SIGINT or SIGTERM,
+// writing a result for every image it changes to stdout. Changes are pushed
+// with label-mod's own credentials, so it refuses to start unless events must
+// carry the secret and name the configured registry.
+func watchWebhooks(addr string, config *WebhookConfig, opts Options) error {
+	if config.Secret == "" {
+		return newError(ErrInvalidArguments, "watch-webhooks requires a secret in the rules file or %s", webhookSecretEnv)
+	}
+	if config.Registry == "" {
+		return newError(ErrInvalidArguments, "watch-webhooks requires the registry to accept pushes from in the rules file")
+	}
+	w := newWatcher(config, opts, os.Stdout)
+	w.start()
+	err := listenAndServe(addr, w.handler())
+	w.stop()
+	return err
+}
+
+// parseWatchArgs returns the rules file and listen address given to watch-webhooks
+func parseWatchArgs(args []string) (string, string) {
+	configPath := ""
+	addr := defaultListenAddr
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--listen" && i+1 < len(args) {
+			addr = args[i+1]
+			i++ // skip the address
+		} else if configPath == "" {
+			configPath = args[i]
+		}
+	}
+
+	return configPath, addr
+}
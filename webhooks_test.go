@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testWebhookRules = `
+rules:
+- name: releases never expire
+  tags: "release-*"
+  remove: [quay.expires-after]
+`
+
+// distributionEvent returns a Docker Distribution notification for a tag push
+func distributionEvent(id, host, repository, tag, digest, userAgent string) string {
+	return `{"events": [
+  {"id": "` + id + `-blob", "action": "push", "target": {"mediaType": "application/octet-stream", "repository": "` + repository + `", "digest": "sha256:abc"}, "request": {"host": "` + host + `"}},
+  {"id": "` + id + `", "action": "push", "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "repository": "` + repository + `", "tag": "` + tag + `", "digest": "` + digest + `", "url": "http://` + host + `/v2/` + repository + `/manifests/` + digest + `"}, "request": {"host": "` + host + `", "useragent": "` + userAgent + `"}},
+  {"id": "` + id + `-pull", "action": "pull", "target": {"repository": "` + repository + `", "tag": "` + tag + `"}}
+]}`
+}
+
+func TestParseDistributionEvents(t *testing.T) {
+	data := []byte(distributionEvent("1", "registry:5000", "org/app", "release-1", "sha256:def", "docker/24"))
+
+	events, err := parseDistributionEvents(data, "")
+	if err != nil {
+		t.Fatalf("Failed to parse events: %v", err)
+	}
+	if len(events) != 1 || events[0].ImageRef != "registry:5000/org/app:release-1" || events[0].Digest != "sha256:def" {
+		t.Errorf("Expected only the tag push, got %+v", events)
+	}
+
+	events, _ = parseDistributionEvents(data, "localhost:5000")
+	if events[0].ImageRef != "localhost:5000/org/app:release-1" {
+		t.Errorf("Expected the configured registry host, got %s", events[0].ImageRef)
+	}
+}
+
+func TestParseQuayEvent(t *testing.T) {
+	data := []byte(`{"repository": "org/app", "namespace": "org", "name": "app", "docker_url": "quay.io/org/app", "homepage": "https://quay.io/repository/org/app", "updated_tags": ["release-1", "latest"]}`)
+
+	events, err := parseQuayEvent(data)
+	if err != nil {
+		t.Fatalf("Failed to parse event: %v", err)
+	}
+	if len(events) != 2 || events[0].ImageRef != "quay.io/org/app:release-1" || events[1].ImageRef != "quay.io/org/app:latest" {
+		t.Errorf("Expected a push per updated tag, got %+v", events)
+	}
+	if _, err := parseQuayEvent([]byte(`{}`)); err == nil {
+		t.Error("Expected events without docker_url to be rejected")
+	}
+}
+
+func TestWatcherProcess(t *testing.T) {
+	config, err := loadWebhookConfig(writeDesiredState(t, testWebhookRules))
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+	host := newTestRegistry(t)
+	repo := host + "/test/watch"
+	pushTestImage(t, repo+":release-1", map[string]string{"quay.expires-after": "1w"})
+	pushTestImage(t, repo+":dev", map[string]string{"quay.expires-after": "1w"})
+	w := newWatcher(config, Options{}, nil)
+
+	result := w.process(pushEvent{ImageRef: repo + ":release-1"})
+	if result == nil || !result.Success || len(result.Removed) != 1 {
+		t.Fatalf("Expected the expiry to be stripped, got %+v", result)
+	}
+	if labels := testImage(repo+":release-1", Options{}).Current; labels["quay.expires-after"] != "" {
+		t.Errorf("Expected the label to be removed, got %v", labels)
+	}
+
+	// The push label-mod just made comes back as an event
+	if w.accept(pushEvent{ImageRef: repo + ":release-1", Digest: result.NewDigest}) {
+		t.Error("Expected the push label-mod caused to be ignored")
+	}
+	if result := w.process(pushEvent{ImageRef: repo + ":release-1"}); result != nil {
+		t.Errorf("Expected nothing to do for label-mod's own digest, got %+v", result)
+	}
+	if result := w.process(pushEvent{ImageRef: repo + ":dev"}); result != nil {
+		t.Errorf("Expected tags outside the rules to be ignored, got %+v", result)
+	}
+
+	if !w.accept(pushEvent{ID: "a", ImageRef: repo + ":release-2"}) || w.accept(pushEvent{ID: "a", ImageRef: repo + ":release-2"}) {
+		t.Error("Expected repeated events to be deduplicated")
+	}
+	if w.accept(pushEvent{ID: "b", ImageRef: repo + ":release-2", UserAgent: userAgent + " go-containerregistry/v0.19.0"}) {
+		t.Error("Expected pushes by label-mod to be ignored")
+	}
+}
+
+func TestWatchWebhooksEndToEnd(t *testing.T) {
+	config, err := loadWebhookConfig(writeDesiredState(t, testWebhookRules))
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+	host := newTestRegistry(t)
+	img := pushTestImage(t, host+"/test/watch:release-1", map[string]string{"quay.expires-after": "1w"})
+	digest, _ := img.Digest()
+
+	config.Secret = "s3cret"
+	config.Registry = host
+
+	var output bytes.Buffer
+	w := newWatcher(config, Options{Output: OutputFormat{Kind: OutputJSONL}}, &output)
+	w.start()
+	server := httptest.NewServer(w.handler())
+	defer server.Close()
+
+	event := distributionEvent("1", host, "test/watch", "release-1", digest.String(), "docker/24")
+	for i := 0; i < 2; i++ {
+		if status := postEvent(t, server.URL+distributionWebhookPath, "s3cret", event); status != http.StatusAccepted {
+			t.Errorf("Expected 202, got %d", status)
+		}
+	}
+	w.stop()
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one result for the deduplicated event, got %q", output.String())
+	}
+	var result Result
+	if err := json.Unmarshal([]byte(lines[0]), &result); err != nil || !result.Success {
+		t.Errorf("Expected a successful result, got %s (%v)", lines[0], err)
+	}
+}
+
+// postEvent posts body to the webhook path of server with an optional token header
+func postEvent(t *testing.T, url, token, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set(webhookTokenHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to post event: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebhookSecret(t *testing.T) {
+	w := newWatcher(&WebhookConfig{Secret: "s3cret", Registry: "quay.io"}, Options{}, &bytes.Buffer{})
+	server := httptest.NewServer(w.handler())
+	defer server.Close()
+	event := `{"docker_url": "quay.io/org/app", "updated_tags": ["latest"]}`
+
+	tests := []struct {
+		name     string
+		url      string
+		token    string
+		expected int
+	}{
+		{"missing", server.URL + quayWebhookPath, "", http.StatusUnauthorized},
+		{"wrong header", server.URL + quayWebhookPath, "guess", http.StatusUnauthorized},
+		{"wrong query", server.URL + quayWebhookPath + "?token=guess", "", http.StatusUnauthorized},
+		{"header", server.URL + quayWebhookPath, "s3cret", http.StatusAccepted},
+		{"query", server.URL + quayWebhookPath + "?token=s3cret", "", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postEvent(t, tt.url, tt.token, event); got != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+	if len(w.queue) != 2 {
+		t.Errorf("Expected only the authorized events to be queued, got %d", len(w.queue))
+	}
+}
+
+func TestWebhookIgnoresOtherRegistries(t *testing.T) {
+	w := newWatcher(&WebhookConfig{Secret: "s3cret", Registry: "registry.example.com"}, Options{}, &bytes.Buffer{})
+	server := httptest.NewServer(w.handler())
+	defer server.Close()
+
+	postEvent(t, server.URL+quayWebhookPath, "s3cret", `{"docker_url": "attacker.example.com/org/app", "updated_tags": ["latest"]}`)
+	postEvent(t, server.URL+quayWebhookPath, "s3cret", `{"docker_url": "registry.example.com/org/app", "updated_tags": ["latest"]}`)
+	postEvent(t, server.URL+distributionWebhookPath, "s3cret", distributionEvent("1", "attacker.example.com", "org/app", "latest", "sha256:def", "docker/24"))
+
+	close(w.queue)
+	var refs []string
+	for event := range w.queue {
+		refs = append(refs, event.ImageRef)
+	}
+	if len(refs) != 2 || refs[0] != "registry.example.com/org/app:latest" || refs[1] != "registry.example.com/org/app:latest" {
+		t.Errorf("Expected only pushes to the configured registry, got %v", refs)
+	}
+}
+
+func TestWatchWebhooksRequiresSecretAndRegistry(t *testing.T) {
+	for _, config := range []*WebhookConfig{
+		{Registry: "registry.example.com"},
+		{Secret: "s3cret"},
+		{},
+	} {
+		err := watchWebhooks("127.0.0.1:0", config, Options{})
+		if err == nil || errorCode(err) != ErrInvalidArguments {
+			t.Errorf("Expected %+v to be refused with invalid-arguments, got %v", config, err)
+		}
+	}
+
+	// Without either, no event is accepted even by a watcher built directly
+	w := newWatcher(&WebhookConfig{}, Options{}, &bytes.Buffer{})
+	server := httptest.NewServer(w.handler())
+	defer server.Close()
+	if status := postEvent(t, server.URL+quayWebhookPath, "", `{"docker_url": "quay.io/org/app", "updated_tags": ["latest"]}`); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a secret, got %d", status)
+	}
+}